@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+// cloneSweepInterval is how often clones whose claim was deleted are cleaned up
+const cloneSweepInterval = time.Minute
+
+// cloneOperation is the copy of a data source into a newly provisioned volume running in the background.  pv is
+// returned to the controller once the copy is done.
+type cloneOperation struct {
+	pv   *v1.PersistentVolume
+	done chan struct{}
+	err  error
+
+	// claim, fs, volumePath and className are what's needed to clean up a clone whose claim was deleted
+	claim      *v1.PersistentVolumeClaim
+	fs         *fileSystem
+	volumePath string
+	className  string
+}
+
+// getDataSourcePath returns the local path of the directory the volume should be populated from, or an empty string
+// if the claim has no data source.  Claims can be populated from another claim or from an EFSVolumeSnapshot.
+func (p *efsProvisioner) getDataSourcePath(ctx context.Context, options controller.ProvisionOptions) (string, error) {
+	if dataSourceRef := options.PVC.Spec.DataSourceRef; dataSourceRef != nil && isSnapshotDataSource(dataSourceRef.APIGroup, dataSourceRef.Kind) {
+		if dataSourceRef.Namespace != nil && *dataSourceRef.Namespace != options.PVC.Namespace {
+			return "", fmt.Errorf("snapshot %s/%s is not in the namespace of the claim", *dataSourceRef.Namespace, dataSourceRef.Name)
+		}
+		return p.getSnapshotPath(options.PVC.Namespace, dataSourceRef.Name)
+	}
+
+	dataSource := options.PVC.Spec.DataSource
+	if dataSource == nil {
+		return "", nil
+	}
+
+	if isSnapshotDataSource(dataSource.APIGroup, dataSource.Kind) {
+		return p.getSnapshotPath(options.PVC.Namespace, dataSource.Name)
+	}
+
+	if dataSource.Kind != "PersistentVolumeClaim" || (dataSource.APIGroup != nil && *dataSource.APIGroup != "") {
+		return "", fmt.Errorf("data source %s %s is not supported", dataSource.Kind, dataSource.Name)
+	}
+
+	_, sourcePath, _, err := p.getClaimLocalPath(ctx, options.PVC.Namespace, dataSource.Name)
+	return sourcePath, err
+}
+
+// getClaimLocalPath returns the file system, local path and volume of the given claim, which must be bound to a
+// volume of this provisioner
+func (p *efsProvisioner) getClaimLocalPath(ctx context.Context, namespace, name string) (*fileSystem, string, *v1.PersistentVolume, error) {
+	claim, err := p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to get claim %s/%s: %v", namespace, name, err)
+	}
+
+	if claim.Spec.VolumeName == "" {
+		return nil, "", nil, fmt.Errorf("claim %s/%s is not bound yet", claim.Namespace, claim.Name)
+	}
+
+	volume, err := p.client.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to get volume %s of claim %s/%s: %v", claim.Spec.VolumeName, claim.Namespace, claim.Name, err)
+	}
+
+	fs, remotePath, err := p.getVolumeFileSystem(ctx, volume)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("claim %s/%s was not provisioned by this provisioner: %v", claim.Namespace, claim.Name, err)
+	}
+
+	localPath, err := fs.getLocalPathForRemotePath(remotePath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return fs, localPath, volume, nil
+}
+
+// startClone copies the data source into the new volume in the background.  Copying a large directory takes far
+// longer than the controller should wait on a single claim, so the controller is told to check back later, at which
+// point cloneResult reports the state of the copy.  The volume metadata only records that the copy is complete once it
+// is, so a copy that is interrupted by a restart of the provisioner is done again when the controller retries.
+func (p *efsProvisioner) startClone(options controller.ProvisionOptions, fs *fileSystem, sourcePath, volumePath string, gid *int, pv *v1.PersistentVolume) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	clone := &cloneOperation{
+		pv:         pv,
+		done:       make(chan struct{}),
+		claim:      options.PVC,
+		fs:         fs,
+		volumePath: volumePath,
+		className:  util.GetPersistentVolumeClaimClass(options.PVC),
+	}
+
+	p.clonesLock.Lock()
+	p.clones[options.PVC.UID] = clone
+	p.clonesLock.Unlock()
+
+	go func() {
+		defer close(clone.done)
+
+		klog.Infof("copying %s to %s", sourcePath, volumePath)
+
+		// a previous copy into the same directory may have been interrupted by a restart of the provisioner
+		err := internal.EmptyDirectory(volumePath)
+		if err == nil {
+			err = internal.CopyTree(sourcePath, volumePath, nil, gid)
+		}
+		if err == nil {
+			err = markCloned(volumePath)
+		}
+		if err != nil {
+			clone.err = internal.LogErrorf("failed to copy %s to %s: %v", sourcePath, volumePath, err)
+			p.deleteFailedVolume(fs, volumePath, pv, clone.className)
+			return
+		}
+
+		klog.Infof("finished copying %s to %s", sourcePath, volumePath)
+	}()
+
+	return nil, controller.ProvisioningInBackground, fmt.Errorf("copying %s to %s", sourcePath, volumePath)
+}
+
+// markCloned records in the volume metadata of the given directory that the copy of its data source is complete
+func markCloned(volumePath string) error {
+	md, err := internal.ReadVolumeMetadata(volumePath)
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		return fmt.Errorf("%s has no volume metadata", volumePath)
+	}
+
+	now := time.Now().UTC()
+	md.ClonedAt = &now
+
+	return internal.WriteVolumeMetadata(volumePath, *md)
+}
+
+// interruptedClone returns the volume metadata of the directory of the given claim if a copy of its data source into
+// it was started for the same claim but never completed, e.g. because the provisioner was restarted, or nil otherwise
+func interruptedClone(volumePath string, options controller.ProvisionOptions) (*internal.VolumeMetadata, error) {
+	md, err := internal.ReadVolumeMetadata(volumePath)
+	if err != nil || md == nil {
+		return nil, err
+	}
+
+	if md.PVCUID != string(options.PVC.UID) || !md.CloneIncomplete() {
+		return nil, nil
+	}
+
+	return md, nil
+}
+
+// getClone returns the clone operation for the given claim if there is one
+func (p *efsProvisioner) getClone(options controller.ProvisionOptions) *cloneOperation {
+	p.clonesLock.Lock()
+	defer p.clonesLock.Unlock()
+
+	return p.clones[options.PVC.UID]
+}
+
+// takeClone removes the given clone operation, and returns false if it was already removed by someone else
+func (p *efsProvisioner) takeClone(clone *cloneOperation) bool {
+	p.clonesLock.Lock()
+	defer p.clonesLock.Unlock()
+
+	if p.clones[clone.claim.UID] != clone {
+		return false
+	}
+	delete(p.clones, clone.claim.UID)
+
+	return true
+}
+
+// cloneResult reports the state of the clone operation for the given claim to the controller, handing over the volume
+// once the copy is done
+func (p *efsProvisioner) cloneResult(options controller.ProvisionOptions, clone *cloneOperation) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	select {
+	case <-clone.done:
+	default:
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("still copying the data source of %s/%s", options.PVC.Namespace, options.PVC.Name)
+	}
+
+	if !p.takeClone(clone) {
+		return nil, controller.ProvisioningNoChange, fmt.Errorf("the copy of the data source of %s/%s was cleaned up", options.PVC.Namespace, options.PVC.Name)
+	}
+
+	if clone.err != nil {
+		return nil, controller.ProvisioningFinished, clone.err
+	}
+
+	return clone.pv, controller.ProvisioningFinished, nil
+}
+
+// runCloneSweeper periodically cleans up clones whose claim was deleted
+func (p *efsProvisioner) runCloneSweeper(ctx context.Context) {
+	go wait.UntilWithContext(ctx, p.sweepClones, cloneSweepInterval)
+}
+
+// sweepClones cleans up the finished clones whose claim was deleted, which the controller never asks about again.  A
+// clone that is still copying is cleaned up once it's finished.
+func (p *efsProvisioner) sweepClones(ctx context.Context) {
+	p.clonesLock.Lock()
+	clones := make([]*cloneOperation, 0, len(p.clones))
+	for _, clone := range p.clones {
+		clones = append(clones, clone)
+	}
+	p.clonesLock.Unlock()
+
+	for _, clone := range clones {
+		select {
+		case <-clone.done:
+		default:
+			continue
+		}
+
+		claim, err := p.client.CoreV1().PersistentVolumeClaims(clone.claim.Namespace).Get(ctx, clone.claim.Name, metav1.GetOptions{})
+		if err == nil && claim.UID == clone.claim.UID {
+			continue
+		} else if err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("failed to get claim %s/%s: %v", clone.claim.Namespace, clone.claim.Name, err)
+			continue
+		}
+
+		if !p.takeClone(clone) {
+			continue
+		}
+
+		klog.Infof("cleaning up %s, whose claim %s/%s was deleted", clone.volumePath, clone.claim.Namespace, clone.claim.Name)
+
+		// a failed copy was already cleaned up
+		if clone.err == nil {
+			p.deleteFailedVolume(clone.fs, clone.volumePath, clone.pv, clone.className)
+		}
+	}
+}
+
+// failedVolume builds as much of the PV of a volume whose provisioning failed as deleteFailedVolume needs
+func failedVolume(options controller.ProvisionOptions, gid *int) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: options.PVName, Annotations: map[string]string{}}}
+	if gid != nil {
+		pv.Annotations[gidallocator.VolumeGidAnnotationKey] = strconv.Itoa(*gid)
+	}
+	return pv
+}
+
+// deleteFailedVolume removes everything that was provisioned for a volume that is never handed to the controller
+func (p *efsProvisioner) deleteFailedVolume(fs *fileSystem, volumePath string, pv *v1.PersistentVolume, className string) {
+	if err := os.RemoveAll(volumePath); err != nil {
+		klog.Errorf("failed to remove %s: %v", volumePath, err)
+	}
+	internal.DeleteVolumeMetadata(volumePath)
+
+	// the allocator finds the gid table by the storage class of the volume, which the controller only sets later
+	volume := pv.DeepCopy()
+	volume.Spec.StorageClassName = className
+	if err := fs.allocator.Release(context.Background(), volume); err != nil {
+		klog.Errorf("failed to release the gid of %s: %v", volumePath, err)
+	}
+
+	if accessPointID, ok := pv.Annotations[accessPointIDAnnotationKey]; ok {
+		if err := internal.DeleteAccessPoint(context.Background(), p.efs, accessPointID); err != nil {
+			klog.Errorf("%v", err)
+		}
+	}
+}
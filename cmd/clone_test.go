@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+)
+
+// newTestCloneSource creates the claim and NFS volume of the data source of a clone
+func newTestCloneSource() []runtime.Object {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "source", Namespace: "default"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pvc-source"},
+	}
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-source"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Server: testDNSName, Path: "/source-pvc-source"},
+			},
+		},
+	}
+	return []runtime.Object{claim, volume}
+}
+
+// newTestCloneOptions builds the provision options of a claim cloned from the source claim
+func newTestCloneOptions() controller.ProvisionOptions {
+	options := newTestProvisionOptions(map[string]string{"gidMin": "2000", "gidMax": "2100"})
+	options.PVC.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "source"}
+	return options
+}
+
+// waitForClone calls Provision until the clone of the claim is no longer in the background
+func waitForClone(t *testing.T, p *efsProvisioner, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	for i := 0; i < 100; i++ {
+		pv, state, err := p.Provision(context.Background(), options)
+		if state != controller.ProvisioningInBackground {
+			return pv, state, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the clone of %s/%s never finished", options.PVC.Namespace, options.PVC.Name)
+	return nil, "", nil
+}
+
+// writeTestSource creates the directory of the data source of a clone, which holds a single file
+func writeTestSource(t *testing.T, mountpoint string) {
+	sourcePath := path.Join(mountpoint, "source-pvc-source")
+	if err := os.MkdirAll(sourcePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(sourcePath, "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionClone(t *testing.T) {
+	skipUnlessRoot(t)
+
+	p, _ := newTestProvisioner(t, newTestCloneSource()...)
+	mountpoint := p.fileSystems[0].mountpoint
+	writeTestSource(t, mountpoint)
+
+	pv, state, err := waitForClone(t, p, newTestCloneOptions())
+	if err != nil || state != controller.ProvisioningFinished || pv == nil {
+		t.Fatalf("expected the clone to be provisioned, got %v, %s, %v", pv, state, err)
+	}
+
+	volumePath := path.Join(mountpoint, "data-pvc-1")
+	if contents, err := ioutil.ReadFile(path.Join(volumePath, "data")); err != nil || string(contents) != "data" {
+		t.Errorf("expected the data source to be copied, got '%s', %v", contents, err)
+	}
+
+	md, err := internal.ReadVolumeMetadata(volumePath)
+	if err != nil || md == nil {
+		t.Fatalf("failed to read volume metadata: %v", err)
+	}
+	if md.CloneIncomplete() {
+		t.Errorf("expected the volume metadata to record that the copy is complete")
+	}
+}
+
+func TestProvisionCloneRetry(t *testing.T) {
+	skipUnlessRoot(t)
+
+	p, _ := newTestProvisioner(t, newTestCloneSource()...)
+	mountpoint := p.fileSystems[0].mountpoint
+	writeTestSource(t, mountpoint)
+
+	// a copy that was interrupted left a partial directory whose metadata records gid 2050
+	volumePath := path.Join(mountpoint, "data-pvc-1")
+	if err := os.MkdirAll(volumePath, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(volumePath, "partial"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := newTestCloneOptions()
+	md := p.newVolumeMetadata(options, "2050", "", 0775)
+	md.ClonedFrom = path.Join(mountpoint, "source-pvc-source")
+	if err := internal.WriteVolumeMetadata(volumePath, md); err != nil {
+		t.Fatal(err)
+	}
+
+	pv, _, err := waitForClone(t, p, options)
+	if err != nil {
+		t.Fatalf("expected the clone to be retried, got %v", err)
+	}
+	if gid := pv.Annotations[gidallocator.VolumeGidAnnotationKey]; gid != "2050" {
+		t.Errorf("expected the clone to keep gid 2050, got '%s'", gid)
+	}
+	if _, err := os.Stat(path.Join(volumePath, "partial")); !os.IsNotExist(err) {
+		t.Errorf("expected the partial copy to be replaced, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(volumePath, "data")); err != nil {
+		t.Errorf("expected the data source to be copied: %v", err)
+	}
+}
+
+func TestSweepClones(t *testing.T) {
+	skipUnlessRoot(t)
+
+	p, _ := newTestProvisioner(t, newTestCloneSource()...)
+	mountpoint := p.fileSystems[0].mountpoint
+	writeTestSource(t, mountpoint)
+
+	options := newTestCloneOptions()
+	if _, state, _ := p.Provision(context.Background(), options); state != controller.ProvisioningInBackground {
+		t.Fatalf("expected the clone to run in the background, got %s", state)
+	}
+	<-p.getClone(options).done
+
+	// the claim of the clone was never created in the fake client, as if it had been deleted
+	p.sweepClones(context.Background())
+
+	if clone := p.getClone(options); clone != nil {
+		t.Errorf("expected the clone to be forgotten")
+	}
+	if _, err := os.Stat(path.Join(mountpoint, "data-pvc-1")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of the clone to be deleted, got %v", err)
+	}
+	if gid, err := p.fileSystems[0].allocator.AllocateNext(context.Background(), options, nil); err != nil || gid != 2000 {
+		t.Errorf("expected the gid of the clone to be released, got %d, %v", gid, err)
+	}
+}
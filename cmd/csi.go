@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	csiDriverName = "efs.csi.aws.com"
+
+	volumeTypeNFS = "nfs"
+	volumeTypeCSI = "csi"
+)
+
+var (
+	defaultNFSMountOptions = []string{"vers=4.1"}
+	// the EFS CSI driver requires TLS whenever an access point is used, so use it for everything by default
+	defaultCSIMountOptions = []string{"tls"}
+)
+
+// csiVolumeHandle builds the volume handle understood by the EFS CSI driver.  Volumes that are mounted through an
+// access point are identified by the access point alone since the access point already knows its root directory.
+func csiVolumeHandle(fileSystemID, remotePath, accessPointID string) string {
+	if accessPointID != "" {
+		return fileSystemID + "::" + accessPointID
+	}
+
+	return fileSystemID + ":" + remotePath
+}
+
+// parseCSIVolumeHandle splits a volume handle of the form fs-id[:path[:access-point-id]] into its parts.
+func parseCSIVolumeHandle(handle string) (fileSystemID, remotePath, accessPointID string, err error) {
+	parts := strings.Split(handle, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return "", "", "", fmt.Errorf("invalid EFS CSI volume handle '%s'", handle)
+	}
+
+	fileSystemID = parts[0]
+	if len(parts) > 1 {
+		remotePath = parts[1]
+	}
+	if len(parts) > 2 {
+		accessPointID = parts[2]
+	}
+
+	return fileSystemID, remotePath, accessPointID, nil
+}
+
+func csiVolumeSource(fileSystemID, remotePath, accessPointID string) v1.PersistentVolumeSource {
+	return v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{
+			Driver:       csiDriverName,
+			VolumeHandle: csiVolumeHandle(fileSystemID, remotePath, accessPointID),
+		},
+	}
+}
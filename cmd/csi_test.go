@@ -0,0 +1,47 @@
+package cmd
+
+import "testing"
+
+func TestParseCSIVolumeHandle(t *testing.T) {
+	tests := []struct {
+		handle                                string
+		fileSystemID, remotePath, accessPoint string
+		valid                                 bool
+	}{
+		{handle: "fs-1", fileSystemID: "fs-1", valid: true},
+		{handle: "fs-1:/data-pvc-1", fileSystemID: "fs-1", remotePath: "/data-pvc-1", valid: true},
+		{handle: "fs-1::fsap-1", fileSystemID: "fs-1", accessPoint: "fsap-1", valid: true},
+		{handle: "fs-1:/data:fsap-1", fileSystemID: "fs-1", remotePath: "/data", accessPoint: "fsap-1", valid: true},
+		{handle: "", valid: false},
+		{handle: ":/data", valid: false},
+		{handle: "fs-1:/data:fsap-1:extra", valid: false},
+	}
+
+	for _, test := range tests {
+		fileSystemID, remotePath, accessPointID, err := parseCSIVolumeHandle(test.handle)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("expected volume handle '%s' to be invalid", test.handle)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("failed to parse volume handle '%s': %v", test.handle, err)
+			continue
+		}
+		if fileSystemID != test.fileSystemID || remotePath != test.remotePath || accessPointID != test.accessPoint {
+			t.Errorf("volume handle '%s' parsed as %s, %s, %s instead of %s, %s, %s", test.handle,
+				fileSystemID, remotePath, accessPointID, test.fileSystemID, test.remotePath, test.accessPoint)
+		}
+	}
+}
+
+func TestCSIVolumeHandleRoundTrip(t *testing.T) {
+	for _, handle := range []string{csiVolumeHandle("fs-1", "/data", ""), csiVolumeHandle("fs-1", "/data", "fsap-1")} {
+		fileSystemID, _, _, err := parseCSIVolumeHandle(handle)
+		if err != nil || fileSystemID != "fs-1" {
+			t.Errorf("volume handle '%s' doesn't parse back to file system fs-1: %v", handle, err)
+		}
+	}
+}
@@ -20,13 +20,17 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/OneCause/efs-provisioner/internal"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
@@ -34,15 +38,21 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
-	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/mount"
 )
 
 const (
@@ -50,39 +60,57 @@ const (
 	fileSystemIDKey    = "FILE_SYSTEM_ID"
 	awsRegionKey       = "AWS_REGION"
 	dnsNameKey         = "DNS_NAME"
+
+	metricsPortKey = "METRICS_PORT"
+
+	archiveTTLKey           = "ARCHIVE_TTL"
+	archiveSweepIntervalKey = "ARCHIVE_SWEEP_INTERVAL"
+
+	defaultArchiveSweepInterval = time.Hour
+
+	accessPointIDAnnotationKey = "efs.onecause.com/access-point-id"
+	// accessPointRootDirAnnotationKey records the root directory of the access point of a volume, so that the volume
+	// can still be deleted if the access point is already gone
+	accessPointRootDirAnnotationKey = "efs.onecause.com/access-point-root-dir"
+
+	// uidAnnotationKey is set on claims to choose the UID that owns the directory of their volume, and on volumes
+	// whose directory is owned by a chosen UID
+	uidAnnotationKey = "efs.onecause.com/uid"
+
+	provisioningModeDirectory   = "directory"
+	provisioningModeAccessPoint = "accessPoint"
+
+	onDeleteDelete  = "delete"
+	onDeleteArchive = "archive"
 )
 
 var _ controller.Provisioner = &efsProvisioner{}
 
 type efsProvisioner struct {
-	dnsName    string
-	mountpoint string
-	source     string
-	allocator  gidallocator.Allocator
+	// fileSystems are the file systems volumes are provisioned from, the first one being the default
+	fileSystems []*fileSystem
+	// name is the name of the provisioner that storage classes refer to
+	name   string
+	efs    efsiface.EFSAPI
+	client kubernetes.Interface
+
+	// clones are the copies of data sources into new volumes that are running in the background, keyed by claim
+	clones     map[types.UID]*cloneOperation
+	clonesLock sync.Mutex
+
+	// snapshots is nil unless snapshots are enabled
+	snapshots *snapshotController
+
+	recorder record.EventRecorder
 }
 
 // NewEFSProvisioner creates an AWS EFS volume provisioner
 func NewEFSProvisioner(client kubernetes.Interface) controller.Provisioner {
-	fileSystemID := os.Getenv(fileSystemIDKey)
-	if fileSystemID == "" {
-		klog.Fatalf("environment variable %s is not set! Please set it.", fileSystemIDKey)
-	}
-
-	awsRegion := os.Getenv(awsRegionKey)
-	if awsRegion == "" {
-		klog.Fatalf("environment variable %s is not set! Please set it.", awsRegionKey)
-	}
-
-	dnsName := os.Getenv(dnsNameKey)
-	klog.Errorf("%s", dnsName)
-	if dnsName == "" {
-		dnsName = getDNSName(fileSystemID, awsRegion)
-	}
+	return newEFSProvisioner(client)
+}
 
-	mountpoint, source, err := getMount(dnsName)
-	if err != nil {
-		klog.Fatal(err)
-	}
+func newEFSProvisioner(client kubernetes.Interface) *efsProvisioner {
+	awsRegion, configs := getFileSystemConfig()
 
 	sess, err := session.NewSession()
 	if err != nil {
@@ -90,20 +118,39 @@ func NewEFSProvisioner(client kubernetes.Interface) controller.Provisioner {
 	}
 
 	svc := efs.New(sess, &aws.Config{Region: aws.String(awsRegion)})
-	params := &efs.DescribeFileSystemsInput{
-		FileSystemId: aws.String(fileSystemID),
-	}
 
-	_, err = svc.DescribeFileSystems(params)
-	if err != nil {
-		klog.Warningf("couldn't confirm that the EFS file system exists: %v", err)
+	fileSystems := make([]*fileSystem, 0, len(configs))
+	for _, config := range configs {
+		fs, err := newFileSystem(client, config, true)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		if err := checkMountpoint(fileSystems, fs); err != nil {
+			klog.Fatal(err)
+		}
+
+		params := &efs.DescribeFileSystemsInput{
+			FileSystemId: aws.String(fs.id),
+		}
+
+		_, err = svc.DescribeFileSystems(params)
+		if err != nil {
+			klog.Warningf("couldn't confirm that the EFS file system %s exists: %v", fs.id, err)
+		}
+
+		fileSystems = append(fileSystems, fs)
 	}
 
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+
 	return &efsProvisioner{
-		dnsName:    dnsName,
-		mountpoint: mountpoint,
-		source:     source,
-		allocator:  gidallocator.NewWithGIDReclaimer(client, internal.NewFileSystemReclaimer(mountpoint)),
+		fileSystems: fileSystems,
+		name:        os.Getenv(provisionerNameKey),
+		efs:         svc,
+		client:      client,
+		clones:      map[types.UID]*cloneOperation{},
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "efs-provisioner"}),
 	}
 }
 
@@ -111,24 +158,6 @@ func getDNSName(fileSystemID, awsRegion string) string {
 	return fileSystemID + ".efs." + awsRegion + ".amazonaws.com"
 }
 
-func getMount(dnsName string) (string, string, error) {
-	entries, err := mount.GetMounts()
-	if err != nil {
-		return "", "", err
-	}
-	for _, e := range entries {
-		if strings.HasPrefix(e.Source, dnsName) {
-			return e.Mountpoint, e.Source, nil
-		}
-	}
-
-	entriesStr := ""
-	for _, e := range entries {
-		entriesStr += e.Source + ":" + e.Mountpoint + ", "
-	}
-	return "", "", fmt.Errorf("no mount entry found for %s among entries %s", dnsName, entriesStr)
-}
-
 func reuseVolumesOption(options controller.ProvisionOptions) (bool, error) {
 	if reuseStr, ok := options.StorageClass.Parameters["reuseVolumes"]; ok {
 		reuse, err := strconv.ParseBool(reuseStr)
@@ -140,13 +169,186 @@ func reuseVolumesOption(options controller.ProvisionOptions) (bool, error) {
 	return false, nil
 }
 
+func provisioningModeOption(options controller.ProvisionOptions) (string, error) {
+	mode, ok := options.StorageClass.Parameters["provisioningMode"]
+	if !ok {
+		return provisioningModeDirectory, nil
+	}
+
+	switch mode {
+	case provisioningModeDirectory, provisioningModeAccessPoint:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value '%s' for parameter provisioningMode: must be %s or %s", mode, provisioningModeDirectory, provisioningModeAccessPoint)
+	}
+}
+
+func volumeTypeOption(options controller.ProvisionOptions) (string, error) {
+	volumeType, ok := options.StorageClass.Parameters["volumeType"]
+	if !ok {
+		return volumeTypeNFS, nil
+	}
+
+	switch volumeType {
+	case volumeTypeNFS, volumeTypeCSI:
+		return volumeType, nil
+	default:
+		return "", fmt.Errorf("invalid value '%s' for parameter volumeType: must be %s or %s", volumeType, volumeTypeNFS, volumeTypeCSI)
+	}
+}
+
+func onDeleteOption(parameters map[string]string) (string, error) {
+	onDelete, ok := parameters["onDelete"]
+	if !ok {
+		return onDeleteDelete, nil
+	}
+
+	switch onDelete {
+	case onDeleteDelete, onDeleteArchive:
+		return onDelete, nil
+	default:
+		return "", fmt.Errorf("invalid value '%s' for parameter onDelete: must be %s or %s", onDelete, onDeleteDelete, onDeleteArchive)
+	}
+}
+
+func gidAllocateOption(parameters map[string]string) (bool, error) {
+	gidAllocate := true
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "gidmin":
+			// Let allocator handle
+		case "gidmax":
+			// Let allocator handle
+		case "gidallocate":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return false, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			gidAllocate = b
+		}
+	}
+
+	return gidAllocate, nil
+}
+
+// directoryModeOption determines the mode of the directory of the volume from the directoryMode, setgid and sticky
+// parameters.  By default, directories with an allocated gid are only accessible to that group and setgid so that
+// new files get the group too, and directories without one are accessible to everyone.
+func directoryModeOption(parameters map[string]string, gidAllocate bool) (os.FileMode, error) {
+	mode := os.FileMode(0777)
+	if gidAllocate {
+		mode = 0771
+	}
+
+	if modeStr, ok := parameters["directoryMode"]; ok {
+		perm, err := strconv.ParseUint(modeStr, 8, 32)
+		if err != nil || perm > 0777 {
+			return 0, fmt.Errorf("invalid value '%s' for parameter directoryMode: must be an octal mode between 0000 and 0777", modeStr)
+		}
+		mode = os.FileMode(perm)
+	}
+
+	for param, bit := range map[string]os.FileMode{"setgid": os.ModeSetgid, "sticky": os.ModeSticky} {
+		enabled := param == "setgid" && gidAllocate
+		if v, ok := parameters[param]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s' for parameter %s: %v", v, param, err)
+			}
+			enabled = b
+		}
+
+		if enabled {
+			mode |= bit
+		}
+	}
+
+	return mode, nil
+}
+
+// checkACLOptions refuses the aclAccess and aclDefault parameters.  EFS doesn't support POSIX ACLs, so they can't be
+// set on the directories of volumes, and ignoring them would leave the groups they name without the access they were
+// meant to grant.
+func checkACLOptions(parameters map[string]string) error {
+	for _, param := range []string{"aclAccess", "aclDefault"} {
+		if _, ok := parameters[param]; ok {
+			return fmt.Errorf("parameter %s is not supported since EFS doesn't support POSIX ACLs, add the gid of the volume to the supplemental groups of the pods that need access to it instead", param)
+		}
+	}
+
+	return nil
+}
+
+// uidOption determines the UID that should own the directory of the volume.  Claims can choose a UID within the
+// uidMin-uidMax range of the storage class with the efs.onecause.com/uid annotation, otherwise the uid parameter of
+// the storage class is used.  The directory is owned by the provisioner if neither is set.
+func uidOption(options controller.ProvisionOptions) (*int, error) {
+	uidMin, uidMax, hasRange, err := internal.UIDRange(options.StorageClass.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if uidStr, ok := options.PVC.Annotations[uidAnnotationKey]; ok {
+		if !hasRange {
+			return nil, fmt.Errorf("storage class %s doesn't allow claims to choose a uid, set uidMin or uidMax to allow it", options.StorageClass.Name)
+		}
+
+		uid, err := strconv.ParseInt(uidStr, 10, 32)
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("invalid value '%s' for annotation %s: must be a uid", uidStr, uidAnnotationKey)
+		}
+
+		if int(uid) < uidMin || int(uid) > uidMax {
+			return nil, fmt.Errorf("uid %d is outside of the range %d-%d of storage class %s", uid, uidMin, uidMax, options.StorageClass.Name)
+		}
+
+		result := int(uid)
+		return &result, nil
+	}
+
+	uidStr, ok := options.StorageClass.Parameters["uid"]
+	if !ok {
+		return nil, nil
+	}
+
+	uid, err := strconv.ParseInt(uidStr, 10, 32)
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("invalid value '%s' for parameter uid: must be a uid", uidStr)
+	}
+
+	if hasRange && (int(uid) < uidMin || int(uid) > uidMax) {
+		return nil, fmt.Errorf("parameter uid %d is outside of the range %d-%d", uid, uidMin, uidMax)
+	}
+
+	if uid == 0 {
+		if allowRoot, err := internal.AllowRootUID(options.StorageClass.Parameters); err != nil {
+			return nil, err
+		} else if !allowRoot {
+			return nil, fmt.Errorf("parameter uid 0 makes root own the directory, set allowRootUid to allow it")
+		}
+	}
+
+	result := int(uid)
+	return &result, nil
+}
+
 // Provision creates a storage asset and returns a PV object representing it.
-func (p *efsProvisioner) Provision(_ context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+func (p *efsProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	if options.PVC.Spec.Selector != nil {
 		return nil, controller.ProvisioningNoChange, fmt.Errorf("claim.Spec.Selector is not supported")
 	}
 
-	volumePath, err := p.getLocalPath(options)
+	if clone := p.getClone(options); clone != nil {
+		return p.cloneResult(options, clone)
+	}
+
+	fs, err := p.getFileSystem(options)
+	if err != nil {
+		klog.Errorf("Failed to provision volume: %v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	volumePath, err := fs.getLocalPath(options)
 	if err != nil {
 		klog.Errorf("Failed to provision volume: %v", err)
 		return nil, controller.ProvisioningNoChange, err
@@ -154,7 +356,9 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 
 	klog.Infof("provisioning volume at %s", volumePath)
 
+	className := util.GetPersistentVolumeClaimClass(options.PVC)
 	volExists := false
+	cloneIncomplete := false
 	var existingGid uint32
 	var gid *int
 	var reuseVolumes bool
@@ -164,6 +368,79 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 		return nil, controller.ProvisioningNoChange, err
 	}
 
+	provisioningMode, err := provisioningModeOption(options)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	volumeType, err := volumeTypeOption(options)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	// only the EFS CSI driver mounts through the access point, NFS volumes would bypass the identity it enforces
+	if provisioningMode == provisioningModeAccessPoint && volumeType != volumeTypeCSI {
+		return nil, controller.ProvisioningNoChange, internal.LogErrorf("provisioningMode %s requires volumeType %s", provisioningModeAccessPoint, volumeTypeCSI)
+	}
+
+	// onDelete is only needed when the volume is deleted, but an invalid value is better reported now
+	if _, err := onDeleteOption(options.StorageClass.Parameters); err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	if _, err := quotaActionOption(options.StorageClass.Parameters); err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	uid, err := uidOption(options)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	gidAllocate, err := gidAllocateOption(options.StorageClass.Parameters)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	// the strategy and reclaiming by owner are only needed when gids are allocated, but invalid values are better reported now
+	if _, err := internal.GIDAllocationStrategy(options.StorageClass.Parameters); err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	if _, err := internal.GIDReclaimByOwner(options.StorageClass.Parameters); err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	mode, err := directoryModeOption(options.StorageClass.Parameters, gidAllocate)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	if err := checkACLOptions(options.StorageClass.Parameters); err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	sourcePath, err := p.getDataSourcePath(ctx, options)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
+	templatePath, err := fs.getTemplatePath(options.StorageClass.Parameters)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return nil, controller.ProvisioningNoChange, err
+	}
+
 	if reuseVolumes {
 		volExists, existingGid, err = internal.VolumeExists(volumePath) // existingGid is the actual gid on the directory in the file system
 		if err != nil {
@@ -176,11 +453,14 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 		klog.Infof("%s already exists", volumePath)
 
 		md, err := internal.ReadVolumeMetadata(volumePath)
+		if errors.Is(err, internal.ErrInvalidMetadataSignature) {
+			p.recorder.Eventf(options.PVC, v1.EventTypeWarning, "VolumeMetadataTampered", "Refusing to reuse %s since its volume metadata was modified outside of the provisioner", volumePath)
+		}
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, internal.LogErrorf("failed to read volume metadata for %s: %v", volumePath, err)
 		}
 
-		err = internal.ValidatePreexistingVolume(options, md, volumePath, existingGid)
+		err = internal.ValidatePreexistingVolume(options, md, volumePath, existingGid, mode)
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, err
 		}
@@ -188,9 +468,9 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 		// if a GID was previously allocated and it matches the actual GID on the current directory then use it
 		if md.GID != "" {
 			existingGidInt := int(existingGid)
-			mdGidInt, err := strconv.Atoi(md.GID)
+			mdGidInt, err := internal.ParseGID(md.GID)
 			if err != nil {
-				return nil, controller.ProvisioningNoChange, internal.LogErrorf("volume metadata contains an invalid GID value: %d", md.GID)
+				return nil, controller.ProvisioningNoChange, internal.LogErrorf("volume metadata contains an invalid GID value: %s", md.GID)
 			}
 
 			if existingGidInt == mdGidInt {
@@ -200,71 +480,151 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 			}
 		}
 
+		// the owner of the directory was checked against the metadata, but the claim may ask for a different one now
+		var requestedUID string
+		if uid != nil {
+			requestedUID = strconv.Itoa(*uid)
+		}
+		if requestedUID != md.UID {
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("%s already exists but the volume metadata says it is owned by uid '%s' instead of the requested uid '%s'", volumePath, md.UID, requestedUID)
+		}
+
+		// the copy of the data source of a reused directory is done again if it never completed
+		cloneIncomplete = md.CloneIncomplete()
+		if cloneIncomplete && sourcePath == "" {
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("%s already exists but the copy of its data source %s never completed", volumePath, md.ClonedFrom)
+		}
+
+		recordVolumeBinding(md, options)
+		if err := internal.WriteVolumeMetadata(volumePath, *md); err != nil {
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("failed to record the binding of %s in its metadata: %v", volumePath, err)
+		}
+
 		klog.Infof("%s was reused since the preexisting volume metadata matches the PVC", volumePath)
 	} else {
-		gidAllocate := true
-		for k, v := range options.StorageClass.Parameters {
-			switch strings.ToLower(k) {
-			case "gidmin":
-				// Let allocator handle
-			case "gidmax":
-				// Let allocator handle
-			case "gidallocate":
-				b, err := strconv.ParseBool(v)
-				if err != nil {
-					return nil, controller.ProvisioningNoChange, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
-				}
-				gidAllocate = b
+		if provisioningMode == provisioningModeAccessPoint && !gidAllocate {
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("provisioningMode %s requires gidAllocate to be enabled", provisioningModeAccessPoint)
+		}
+
+		// a clone interrupted by a restart of the provisioner is retried in the directory it left behind, which keeps
+		// the gid it was allocated
+		var interrupted *internal.VolumeMetadata
+		if sourcePath != "" {
+			if interrupted, err = interruptedClone(volumePath, options); err != nil {
+				return nil, controller.ProvisioningNoChange, internal.LogErrorf("failed to read volume metadata for %s: %v", volumePath, err)
 			}
 		}
 
-		if gidAllocate {
-			allocate, err := p.allocator.AllocateNext(options)
+		if gidAllocate && interrupted != nil && interrupted.GID != "" {
+			allocated, err := internal.ParseGID(interrupted.GID)
+			if err != nil {
+				return nil, controller.ProvisioningNoChange, internal.LogErrorf("volume metadata contains an invalid GID value: %s", interrupted.GID)
+			}
+			klog.Infof("retrying the interrupted copy of %s to %s with gid %d", sourcePath, volumePath, allocated)
+			gid = &allocated
+		} else if gidAllocate {
+			sharedClassNames, err := p.sharedGIDClasses(ctx, options)
+			if err != nil {
+				return nil, controller.ProvisioningNoChange, internal.LogErrorf("%v", err)
+			}
+
+			allocate, err := fs.allocator.AllocateNext(ctx, options, sharedClassNames)
 			if err != nil {
 				return nil, controller.ProvisioningNoChange, err
 			}
 			gid = &allocate
 		}
 
-		err := p.createVolume(volumePath, gid)
+		err := p.createVolume(volumePath, gid, uid, mode)
 		if err != nil {
+			p.deleteFailedVolume(fs, volumePath, failedVolume(options, gid), className)
 			return nil, controller.ProvisioningNoChange, err
 		}
 
-		var gidstr string
+		var gidstr, uidstr string
 		if gid != nil {
 			gidstr = strconv.Itoa(*gid)
 		}
+		if uid != nil {
+			uidstr = strconv.Itoa(*uid)
+		}
 
-		if reuseVolumes {
-			internal.WriteVolumeMetadata(volumePath,
-				internal.VolumeMetadata{
-					GID:              gidstr,
-					PVCName:          options.PVC.Name,
-					PVCNamespace:     options.PVC.Namespace,
-					StorageClassName: util.GetPersistentVolumeClaimClass(options.PVC),
-				})
+		md := p.newVolumeMetadata(options, gidstr, uidstr, mode)
+		md.ClonedFrom = sourcePath
+
+		// without metadata the directory could neither be reused nor have its gid reclaimed, so it's of no use
+		if err := internal.WriteVolumeMetadata(volumePath, md); err != nil {
+			p.deleteFailedVolume(fs, volumePath, failedVolume(options, gid), className)
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("failed to write metadata of %s: %v", volumePath, err)
 		}
 	}
 
-	mountOptions := []string{"vers=4.1"}
+	mountOptions := defaultNFSMountOptions
+	if volumeType == volumeTypeCSI {
+		mountOptions = defaultCSIMountOptions
+	}
 	if options.StorageClass.MountOptions != nil {
 		mountOptions = options.StorageClass.MountOptions
 	}
 
-	remotePath, err := p.getRemotePath(options)
+	remotePath, err := fs.getRemotePath(options)
 	if err != nil {
 		klog.Errorf("failed to get remote path: %s", err)
 		return nil, controller.ProvisioningNoChange, err
 	}
 
+	annotations := map[string]string{}
+	var accessPointID string
+
+	if gid != nil {
+		annotations[gidallocator.VolumeGidAnnotationKey] = strconv.FormatInt(int64(*gid), 10)
+	}
+	if uid != nil {
+		annotations[uidAnnotationKey] = strconv.Itoa(*uid)
+	}
+
+	// the access point enforces the volume's identity for every client that mounts through it, so the gid of the
+	// access point's POSIX user is the allocated gid, and so is its uid unless the directory is owned by a chosen uid
+	if provisioningMode == provisioningModeAccessPoint {
+		if gid == nil {
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("%s has no gid to assign to an access point", volumePath)
+		}
+
+		accessPointUID := int64(*gid)
+		if uid != nil {
+			accessPointUID = int64(*uid)
+		}
+
+		accessPointID, err = internal.CreateAccessPoint(ctx, p.efs, internal.AccessPointOptions{
+			FileSystemID: fs.id,
+			ClientToken:  options.PVName,
+			RootDir:      remotePath,
+			UID:          accessPointUID,
+			GID:          int64(*gid),
+			PVName:       options.PVName,
+			PVCName:      options.PVC.Name,
+			PVCNamespace: options.PVC.Namespace,
+		})
+		if err != nil {
+			klog.Errorf("%v", err)
+			if !volExists {
+				p.deleteFailedVolume(fs, volumePath, failedVolume(options, gid), className)
+			}
+			return nil, controller.ProvisioningNoChange, err
+		}
+
+		annotations[accessPointIDAnnotationKey] = accessPointID
+		annotations[accessPointRootDirAnnotationKey] = remotePath
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			// TODO: if the storage class is configured to reuse existing volumes, should we use a predictable name for the PV so that an existing
 			// one in Released status will get reused (similar for how we handle directories)?  Right now a new one will be made, which doesn't seem
 			// to hurt anything, but it might be weird to continue to have a released volume sit there forever.  If we would opt to reuse the released
 			// PV, then we would either need to modify the controller to pass us a different name, or ignore the name it passed us and use our own.
-			Name: options.PVName,
+			Name:        options.PVName,
+			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
@@ -272,32 +632,31 @@ func (p *efsProvisioner) Provision(_ context.Context, options controller.Provisi
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
-			PersistentVolumeSource: v1.PersistentVolumeSource{
-				NFS: &v1.NFSVolumeSource{
-					Server:   p.dnsName,
-					Path:     remotePath,
-					ReadOnly: false,
-				},
-			},
-			MountOptions: mountOptions,
+			PersistentVolumeSource: fs.volumeSource(volumeType, remotePath, accessPointID),
+			MountOptions:           mountOptions,
 		},
 	}
 
-	if gid != nil {
-		pv.ObjectMeta.Annotations = map[string]string{
-			gidallocator.VolumeGidAnnotationKey: strconv.FormatInt(int64(*gid), 10),
+	// a reused directory already holds the data it was populated with when it was first provisioned, unless the copy
+	// never completed
+	if sourcePath != "" && (!volExists || cloneIncomplete) {
+		return p.startClone(options, fs, sourcePath, volumePath, gid, pv)
+	}
+
+	// the data source of a claim replaces the template, so the template is only copied into empty volumes
+	if templatePath != "" && !volExists {
+		klog.Infof("copying template %s to %s", templatePath, volumePath)
+
+		if err := internal.CopyTree(templatePath, volumePath, uid, gid); err != nil {
+			p.deleteFailedVolume(fs, volumePath, pv, className)
+			return nil, controller.ProvisioningNoChange, internal.LogErrorf("failed to copy template %s to %s: %v", templatePath, volumePath, err)
 		}
 	}
 
 	return pv, controller.ProvisioningFinished, nil
 }
 
-func (p *efsProvisioner) createVolume(path string, gid *int) error {
-	perm := os.FileMode(0777)
-	if gid != nil {
-		perm = os.FileMode(0771 | os.ModeSetgid)
-	}
-
+func (p *efsProvisioner) createVolume(path string, gid, uid *int, perm os.FileMode) error {
 	if err := os.MkdirAll(path, perm); err != nil {
 		return err
 	}
@@ -317,31 +676,23 @@ func (p *efsProvisioner) createVolume(path string, gid *int) error {
 		}
 	}
 
-	return nil
-}
-
-func (p *efsProvisioner) getLocalPath(options controller.ProvisionOptions) (string, error) {
-	dirname, err := p.getDirectoryName(options)
-	if err != nil {
-		return "", err
+	if uid != nil {
+		cmd := exec.Command("chown", strconv.Itoa(*uid), path)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			os.RemoveAll(path)
+			return fmt.Errorf("chown failed with error: %v, output: %s", err, out)
+		}
 	}
-	return path.Join(p.mountpoint, dirname), nil
-}
 
-func (p *efsProvisioner) getRemotePath(options controller.ProvisionOptions) (string, error) {
-	dirname, err := p.getDirectoryName(options)
-	if err != nil {
-		return "", err
-	}
-	sourcePath := path.Clean(strings.Replace(p.source, p.dnsName+":", "", 1))
-	return path.Join(sourcePath, dirname), nil
+	return nil
 }
 
 // getDirectoryName determines the name of the directory to create for the PVC.
 // If we are in "reuse volumes" mode, then we generate a predictable name so that
 // the same PVC will always result in the same directory name.  Otherwise, we generate
 // a unique name using the name of the generated PV
-func (p *efsProvisioner) getDirectoryName(options controller.ProvisionOptions) (string, error) {
+func getDirectoryName(options controller.ProvisionOptions) (string, error) {
 	reuseVolumes, err := reuseVolumesOption(options)
 	if err != nil {
 		return "", err
@@ -361,40 +712,112 @@ func (p *efsProvisioner) getDirectoryName(options controller.ProvisionOptions) (
 
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
-func (p *efsProvisioner) Delete(_ context.Context, volume *v1.PersistentVolume) error {
-	//TODO ignorederror
-	err := p.allocator.Release(volume)
+func (p *efsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	fs, remotePath, err := p.getVolumeFileSystem(ctx, volume)
 	if err != nil {
 		return err
 	}
 
-	path, err := p.getLocalPathToDelete(volume.Spec.NFS)
+	path, err := fs.getLocalPathForRemotePath(remotePath)
 	if err != nil {
 		return err
 	}
 
-	klog.Infof("Deleting %s", path)
-
-	if err := os.RemoveAll(path); err != nil {
+	onDelete, err := p.onDeleteOptionForVolume(ctx, volume)
+	if err != nil {
+		klog.Errorf("%v", err)
 		return err
 	}
 
-	return nil
+	if onDelete == onDeleteArchive {
+		if _, err := os.Stat(path); err == nil {
+			// the annotation of a directory made read-only by the quota action is gone once the volume is
+			if mode, ok := volume.Annotations[quotaReadOnlyAnnotationKey]; ok {
+				if err := internal.RestoreMode(path, mode); err != nil {
+					return err
+				}
+			}
+
+			if _, err := internal.ArchiveVolume(path); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		klog.Infof("Deleting %s", path)
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+
+		if err := internal.DeleteVolumeMetadata(path); err != nil {
+			return err
+		}
+	}
+
+	// the access point is deleted after the directory since the directory of a CSI volume can only be found through its
+	// access point
+	if accessPointID, ok := volume.Annotations[accessPointIDAnnotationKey]; ok {
+		if err := internal.DeleteAccessPoint(ctx, p.efs, accessPointID); err != nil {
+			klog.Errorf("%v", err)
+			return err
+		}
+	}
+
+	// the gid of an archived volume stays allocated until the archive sweeper purges it, so that the volume can be
+	// restored with its gid
+	if onDelete == onDeleteArchive {
+		return nil
+	}
+
+	// the gid is only released once nothing that grants access to the old data is left, since it may be allocated to a
+	// new volume right away
+	return fs.allocator.Release(ctx, volume)
+}
+
+// onDeleteOptionForVolume determines what to do with the directory of the given volume from the onDelete parameter of
+// its storage class.  If the storage class no longer exists, the directory is deleted.
+func (p *efsProvisioner) onDeleteOptionForVolume(ctx context.Context, volume *v1.PersistentVolume) (string, error) {
+	className := util.GetPersistentVolumeClass(volume)
+	if className == "" {
+		return onDeleteDelete, nil
+	}
+
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.Warningf("storage class %s of volume %s no longer exists", className, volume.Name)
+		return onDeleteDelete, nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get storage class %s: %v", className, err)
+	}
+
+	return onDeleteOption(class.Parameters)
 }
 
-func (p *efsProvisioner) getLocalPathToDelete(nfs *v1.NFSVolumeSource) (string, error) {
-	if nfs.Server != p.dnsName {
-		return "", fmt.Errorf("volume's NFS server %s is not equal to the server %s from which this provisioner creates volumes", nfs.Server, p.dnsName)
+// runArchiveSweepers periodically purges archived volumes older than ARCHIVE_TTL from every file system until the
+// context is done.  Archived volumes are kept forever if ARCHIVE_TTL isn't set.
+func (p *efsProvisioner) runArchiveSweepers(ctx context.Context) {
+	ttlStr := os.Getenv(archiveTTLKey)
+	if ttlStr == "" {
+		return
 	}
 
-	sourcePath := path.Clean(strings.Replace(p.source, p.dnsName+":", "", 1))
-	if !strings.HasPrefix(nfs.Path, sourcePath) {
-		return "", fmt.Errorf("volume's NFS path %s is not a child of the server path %s mounted in this provisioner at %s", nfs.Path, p.source, p.mountpoint)
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil {
+		klog.Fatalf("invalid value '%s' for environment variable %s: %v", ttlStr, archiveTTLKey, err)
 	}
 
-	subpath := strings.Replace(nfs.Path, sourcePath, "", 1)
+	interval := defaultArchiveSweepInterval
+	if intervalStr := os.Getenv(archiveSweepIntervalKey); intervalStr != "" {
+		if interval, err = time.ParseDuration(intervalStr); err != nil {
+			klog.Fatalf("invalid value '%s' for environment variable %s: %v", intervalStr, archiveSweepIntervalKey, err)
+		}
+	}
 
-	return path.Join(p.mountpoint, subpath), nil
+	for _, fs := range p.fileSystems {
+		go internal.RunArchiveSweeper(ctx, fs.mountpoint, ttl, interval, fs.allocator)
+	}
 }
 
 // buildKubeConfig builds REST config based on master URL and kubeconfig path.
@@ -412,14 +835,8 @@ func buildKubeConfig() (*rest.Config, error) {
 	}
 }
 
-func Execute() {
-	flag.Parse()
-	flag.Set("logtostderr", "true")
-
-	klog.Info("Starting efs-provisioner")
-
-	// Create an InClusterConfig and use it to create a client for the controller
-	// to use to communicate with Kubernetes
+// buildClient creates a client to use to communicate with Kubernetes
+func buildClient() kubernetes.Interface {
 	config, err := buildKubeConfig()
 	if err != nil {
 		klog.Fatalf("Failed to create config: %v", err)
@@ -428,10 +845,57 @@ func Execute() {
 	if err != nil {
 		klog.Fatalf("Failed to create client: %v", err)
 	}
+	return clientset
+}
+
+// buildDynamicClient creates a client to use to communicate with Kubernetes about custom resources
+func buildDynamicClient() dynamic.Interface {
+	config, err := buildKubeConfig()
+	if err != nil {
+		klog.Fatalf("Failed to create config: %v", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create dynamic client: %v", err)
+	}
+	return client
+}
+
+func Execute() {
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+
+	switch flag.Arg(0) {
+	case "":
+	case migrateToCSICommand:
+		migrateToCSI(flag.Args()[1:])
+		return
+	case restoreCommand:
+		restore(flag.Args()[1:])
+		return
+	case reconcileGIDsCommand:
+		reconcileGIDs(flag.Args()[1:])
+		return
+	default:
+		klog.Fatalf("unknown command %s", flag.Arg(0))
+	}
+
+	klog.Info("Starting efs-provisioner")
+
+	// Create an InClusterConfig and use it to create a client for the controller
+	// to use to communicate with Kubernetes
+	clientset := buildClient()
+
+	// metadata is read and written as soon as the file systems are set up
+	configureMetadataSigning(clientset)
 
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	efsProvisioner := NewEFSProvisioner(clientset)
+	efsProvisioner := newEFSProvisioner(clientset)
+
+	if snapshotsEnabled() {
+		efsProvisioner.snapshots = newSnapshotController(efsProvisioner, buildDynamicClient())
+	}
 
 	provisionerName := os.Getenv(provisionerNameKey)
 	if provisionerName == "" {
@@ -440,13 +904,49 @@ func Execute() {
 
 	// Start the provision controller which will dynamically provision efs NFS
 	// PVs
+	var options []func(*controller.ProvisionController) error
+	if metricsPortStr := os.Getenv(metricsPortKey); metricsPortStr != "" {
+		metricsPort, err := strconv.ParseInt(metricsPortStr, 10, 32)
+		if err != nil {
+			klog.Fatalf("invalid value '%s' for environment variable %s: %v", metricsPortStr, metricsPortKey, err)
+		}
+		options = append(options, controller.MetricsPort(int32(metricsPort)))
+	}
+
 	pc := controller.NewProvisionController(
 		clientset,
 		provisionerName,
 		efsProvisioner,
+		options...,
 	)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	efsProvisioner.watchMounts(ctx)
+	efsProvisioner.warnOverlappingGIDRanges(ctx)
+	efsProvisioner.registerGIDs(ctx)
+	efsProvisioner.runArchiveSweepers(ctx)
+	efsProvisioner.runUsageScanner(ctx, provisionerName)
+	efsProvisioner.runCloneSweeper(ctx)
+
+	if efsProvisioner.snapshots != nil {
+		go efsProvisioner.snapshots.run(ctx)
+	}
+
+	// the controller may exit the process on its own once it is stopped, so file systems mounted by the
+	// provisioner are unmounted here rather than after Run returns
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		klog.Infof("Received %v, shutting down", sig)
+		cancel()
+		efsProvisioner.unmount()
+		os.Exit(0)
+	}()
+
 	klog.Info("Starting provisioner controller")
 
-	pc.Run(context.Background())
+	pc.Run(ctx)
 }
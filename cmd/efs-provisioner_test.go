@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	"github.com/OneCause/efs-provisioner/internal/efstest"
+	"github.com/aws/aws-sdk-go/aws"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+)
+
+const (
+	testProvisionerName = "example.com/aws-efs"
+	testFileSystemID    = "fs-1"
+	testDNSName         = "fs-1.efs.us-east-1.amazonaws.com"
+)
+
+// skipUnlessRoot skips tests that provision volumes, since the provisioner changes the group and owner of the
+// directories of volumes
+func skipUnlessRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the group and owner of volume directories requires root")
+	}
+}
+
+func newTestProvisioner(t *testing.T, objects ...runtime.Object) (*efsProvisioner, *efstest.FakeEFS) {
+	client := fake.NewSimpleClientset(objects...)
+	mountpoint := t.TempDir()
+	svc := efstest.NewFakeEFS()
+
+	return &efsProvisioner{
+		fileSystems: []*fileSystem{{
+			id:         testFileSystemID,
+			dnsName:    testDNSName,
+			mountpoint: mountpoint,
+			source:     testDNSName + ":/",
+			allocator:  internal.NewGIDAllocator(client, internal.NewFileSystemReclaimer(mountpoint), nil, nil),
+		}},
+		name:     testProvisionerName,
+		efs:      svc,
+		client:   client,
+		clones:   map[types.UID]*cloneOperation{},
+		recorder: record.NewFakeRecorder(100),
+	}, svc
+}
+
+// newTestProvisionOptions builds the options the controller passes to Provision for a claim of a storage class with
+// the given parameters
+func newTestProvisionOptions(parameters map[string]string) controller.ProvisionOptions {
+	className := "efs"
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+
+	return controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: className},
+			Provisioner:   testProvisionerName,
+			Parameters:    parameters,
+			ReclaimPolicy: &reclaimPolicy,
+		},
+		PVName: "pvc-1",
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", UID: "1"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &className,
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		},
+	}
+}
+
+func TestProvisionAccessPoint(t *testing.T) {
+	skipUnlessRoot(t)
+
+	p, svc := newTestProvisioner(t)
+	options := newTestProvisionOptions(map[string]string{
+		"provisioningMode": provisioningModeAccessPoint,
+		"volumeType":       volumeTypeCSI,
+		"gidMin":           "2000",
+		"gidMax":           "2100",
+	})
+
+	pv, state, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected provisioning to be finished, got %s", state)
+	}
+
+	accessPointID := pv.Annotations[accessPointIDAnnotationKey]
+	if accessPointID != "fsap-pvc-1" {
+		t.Fatalf("expected access point fsap-pvc-1 in the annotations of the PV, got '%s'", accessPointID)
+	}
+	if rootDir := aws.StringValue(svc.AccessPoints[accessPointID].RootDirectory.Path); rootDir != "/data-pvc-1" {
+		t.Errorf("expected the access point to be rooted at /data-pvc-1, got '%s'", rootDir)
+	}
+	if gid := pv.Annotations[gidallocator.VolumeGidAnnotationKey]; gid != "2000" {
+		t.Errorf("expected gid 2000, got '%s'", gid)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != testFileSystemID+"::"+accessPointID {
+		t.Errorf("expected a CSI volume mounted through the access point, got %+v", pv.Spec.PersistentVolumeSource)
+	}
+
+	volumePath := path.Join(p.fileSystems[0].mountpoint, "data-pvc-1")
+	if _, err := os.Stat(volumePath); err != nil {
+		t.Fatalf("expected %s to be created: %v", volumePath, err)
+	}
+
+	// the controller sets the storage class of the PV
+	pv.Spec.StorageClassName = options.StorageClass.Name
+	if err := p.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, ok := svc.AccessPoints[accessPointID]; ok {
+		t.Errorf("expected access point %s to be deleted", accessPointID)
+	}
+	if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted, got %v", volumePath, err)
+	}
+}
+
+func TestProvisionAccessPointRequiresCSI(t *testing.T) {
+	p, svc := newTestProvisioner(t)
+	options := newTestProvisionOptions(map[string]string{
+		"provisioningMode": provisioningModeAccessPoint,
+	})
+
+	if _, _, err := p.Provision(context.Background(), options); err == nil {
+		t.Fatalf("expected an NFS volume in accessPoint mode to be refused")
+	}
+	if len(svc.AccessPoints) != 0 {
+		t.Errorf("expected no access point to be created, got %v", svc.AccessPoints)
+	}
+}
+
+func TestCheckACLOptions(t *testing.T) {
+	for _, param := range []string{"aclAccess", "aclDefault"} {
+		if err := checkACLOptions(map[string]string{param: "g:5000:r-x"}); err == nil {
+			t.Errorf("expected parameter %s to be refused", param)
+		}
+	}
+
+	if err := checkACLOptions(map[string]string{"gidMin": "2000"}); err != nil {
+		t.Errorf("expected storage classes without ACL parameters to be accepted, got %v", err)
+	}
+}
+
+func TestDeleteAccessPointAlreadyDeleted(t *testing.T) {
+	skipUnlessRoot(t)
+
+	for _, hasRootDirAnnotation := range []bool{true, false} {
+		p, svc := newTestProvisioner(t)
+		options := newTestProvisionOptions(map[string]string{
+			"provisioningMode": provisioningModeAccessPoint,
+			"volumeType":       volumeTypeCSI,
+		})
+
+		pv, _, err := p.Provision(context.Background(), options)
+		if err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+
+		// without the annotation, the root directory is the directory whose volume metadata names the PV
+		if !hasRootDirAnnotation {
+			delete(pv.Annotations, accessPointRootDirAnnotationKey)
+		}
+
+		delete(svc.AccessPoints, pv.Annotations[accessPointIDAnnotationKey])
+
+		if err := p.Delete(context.Background(), pv); err != nil {
+			t.Fatalf("Delete of a volume whose access point is gone failed: %v", err)
+		}
+
+		volumePath := path.Join(p.fileSystems[0].mountpoint, "data-pvc-1")
+		if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted, got %v", volumePath, err)
+		}
+	}
+}
+
+func TestProvisionTemplateOwner(t *testing.T) {
+	skipUnlessRoot(t)
+
+	p, _ := newTestProvisioner(t)
+	mountpoint := p.fileSystems[0].mountpoint
+
+	templatePath := path.Join(mountpoint, "templates", "web")
+	if err := os.MkdirAll(path.Join(templatePath, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(templatePath, "conf", "app.conf"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := newTestProvisionOptions(map[string]string{
+		"gidMin":      "2000",
+		"gidMax":      "2100",
+		"uid":         "1001",
+		"templateDir": "templates/web",
+	})
+	if _, _, err := p.Provision(context.Background(), options); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	volumePath := path.Join(mountpoint, "data-pvc-1")
+	for _, name := range []string{"conf", "conf/app.conf"} {
+		info, err := os.Lstat(path.Join(volumePath, name))
+		if err != nil {
+			t.Fatalf("expected the template to be copied: %v", err)
+		}
+		if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 1001 || stat.Gid != 2000 {
+			t.Errorf("expected %s to be owned by 1001:2000, got %d:%d", name, stat.Uid, stat.Gid)
+		}
+	}
+}
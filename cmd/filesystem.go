@@ -0,0 +1,475 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/mount"
+)
+
+const (
+	mountEFSKey     = "MOUNT_EFS"
+	mountPathKey    = "MOUNT_PATH"
+	mountRootKey    = "MOUNT_ROOT"
+	efsPathKey      = "EFS_PATH"
+	mountOptionsKey = "MOUNT_OPTIONS"
+
+	defaultMountRoot = "/var/lib/efs-provisioner"
+
+	// mountCheckInterval is how often mounts made by the provisioner are checked and remounted if necessary
+	mountCheckInterval = time.Minute
+)
+
+// fileSystemConfig identifies an EFS file system and the DNS name by which it is mounted.  If selfMount is set, the
+// provisioner mounts remotePath of the file system at mountpoint itself.  Otherwise mountpoint, if set, is where the
+// file system is expected to already be mounted.  onlyFileSystem is set if no other file system is configured.
+type fileSystemConfig struct {
+	id             string
+	dnsName        string
+	remotePath     string
+	mountpoint     string
+	selfMount      bool
+	mountOptions   []string
+	onlyFileSystem bool
+}
+
+// fileSystem is an EFS file system mounted in this provisioner from which volumes are provisioned.  Each file system
+// has its own gid allocator since the gids in use are reclaimed from the directories on the file system.
+type fileSystem struct {
+	id         string
+	dnsName    string
+	mountpoint string
+	source     string
+	allocator  *internal.GIDAllocator
+	// mounter is set if the provisioner mounted the file system itself
+	mounter *internal.Mounter
+}
+
+// newFileSystem sets up the file system with the given config.  If migrate is set, the volume metadata older versions
+// kept inside the volumes is migrated first.
+func newFileSystem(client kubernetes.Interface, config fileSystemConfig, migrate bool) (*fileSystem, error) {
+	var mountpoint, source string
+	var mounter *internal.Mounter
+
+	if config.selfMount {
+		mounter = internal.NewMounter(config.dnsName, config.remotePath, config.mountpoint, config.mountOptions)
+		if err := mounter.Mount(); err != nil {
+			return nil, err
+		}
+		mountpoint, source = mounter.Mountpoint, mounter.Source()
+	} else {
+		var err error
+		if mountpoint, source, err = getMount(config); err != nil {
+			return nil, err
+		}
+	}
+
+	klog.Infof("provisioning volumes from %s mounted at %s", config.id, mountpoint)
+
+	if !migrate {
+		klog.Infof("not migrating volume metadata on %s", config.id)
+	} else if err := internal.MigrateVolumeMetadata(mountpoint); err != nil {
+		if mounter != nil {
+			if err := mounter.Unmount(); err != nil {
+				klog.Errorf("%v", err)
+			}
+		}
+		return nil, err
+	}
+
+	return &fileSystem{
+		id:         config.id,
+		dnsName:    config.dnsName,
+		mountpoint: mountpoint,
+		source:     source,
+		allocator:  internal.NewGIDAllocator(client, internal.NewFileSystemReclaimer(mountpoint), newGIDStore(client, config.id), newGIDRegistry(mountpoint)),
+		mounter:    mounter,
+	}, nil
+}
+
+// getFileSystemConfig reads the AWS region and the EFS file systems to provision volumes from out of the environment.
+// FILE_SYSTEM_ID may contain a comma separated list of file system ids, in which case DNS_NAME and EFS_PATH may contain
+// a comma separated list of DNS names and paths in the same order.  Empty DNS names default to the AWS DNS name of the
+// file system and empty paths default to the root of the file system.  If MOUNT_EFS is true, each file system is
+// mounted by the provisioner under MOUNT_ROOT instead of having to be mounted into the pod.  MOUNT_PATH may contain a
+// comma separated list of the paths at which the file systems are mounted, which is required to identify mounts that
+// can't be recognized by their source, and overrides where the provisioner mounts file systems itself.
+func getFileSystemConfig() (string, []fileSystemConfig) {
+	fileSystemIDs := os.Getenv(fileSystemIDKey)
+	if fileSystemIDs == "" {
+		klog.Fatalf("environment variable %s is not set! Please set it.", fileSystemIDKey)
+	}
+
+	awsRegion := os.Getenv(awsRegionKey)
+	if awsRegion == "" {
+		klog.Fatalf("environment variable %s is not set! Please set it.", awsRegionKey)
+	}
+
+	ids := strings.Split(fileSystemIDs, ",")
+	dnsNames := getFileSystemListEnv(dnsNameKey, len(ids))
+	remotePaths := getFileSystemListEnv(efsPathKey, len(ids))
+	mountPaths := getFileSystemListEnv(mountPathKey, len(ids))
+
+	selfMount := false
+	if mountEFS := os.Getenv(mountEFSKey); mountEFS != "" {
+		var err error
+		if selfMount, err = strconv.ParseBool(mountEFS); err != nil {
+			klog.Fatalf("invalid value '%s' for environment variable %s: %v", mountEFS, mountEFSKey, err)
+		}
+	}
+
+	mountRoot := os.Getenv(mountRootKey)
+	if mountRoot == "" {
+		mountRoot = defaultMountRoot
+	}
+
+	mountOptions := internal.DefaultNFSMountOptions
+	if options := os.Getenv(mountOptionsKey); options != "" {
+		mountOptions = strings.Split(options, ",")
+	}
+
+	configs := make([]fileSystemConfig, 0, len(ids))
+	for i, id := range ids {
+		config := fileSystemConfig{
+			id:             strings.TrimSpace(id),
+			dnsName:        dnsNames[i],
+			remotePath:     path.Clean("/" + remotePaths[i]),
+			onlyFileSystem: len(ids) == 1,
+		}
+
+		if config.dnsName == "" {
+			config.dnsName = getDNSName(config.id, awsRegion)
+		}
+
+		if mountPaths[i] != "" {
+			config.mountpoint = path.Clean(mountPaths[i])
+		}
+
+		if selfMount {
+			if config.mountpoint == "" {
+				config.mountpoint = path.Join(mountRoot, config.id)
+			}
+			config.selfMount = true
+			config.mountOptions = mountOptions
+		}
+
+		for _, other := range configs {
+			if other.id == config.id {
+				klog.Fatalf("file system %s is listed more than once in environment variable %s", config.id, fileSystemIDKey)
+			}
+			if config.mountpoint != "" && other.mountpoint == config.mountpoint {
+				klog.Fatalf("file systems %s and %s can't both be mounted at %s", other.id, config.id, config.mountpoint)
+			}
+		}
+
+		configs = append(configs, config)
+	}
+
+	return awsRegion, configs
+}
+
+// getMount finds where the file system is mounted in this provisioner and the source of the mount.  The file system
+// is found at the configured mountpoint, by its DNS name, or as an efs-utils TLS mount, in that order.  A TLS mount
+// that can't be told apart from the mounts of other file systems is only used if no other file system is configured.
+func getMount(config fileSystemConfig) (string, string, error) {
+	entries, err := mount.GetMounts()
+	if err != nil {
+		return "", "", err
+	}
+
+	if config.mountpoint != "" {
+		for _, e := range entries {
+			if e.Mountpoint == config.mountpoint {
+				return e.Mountpoint, e.Source, nil
+			}
+		}
+		return "", "", fmt.Errorf("nothing is mounted at %s configured for %s", config.mountpoint, config.id)
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Source, config.dnsName) {
+			return e.Mountpoint, e.Source, nil
+		}
+	}
+
+	if e := internal.FindStunnelMount(config.id, entries, config.onlyFileSystem); e != nil {
+		klog.Infof("using efs-utils TLS mount %s at %s for %s", e.Source, e.Mountpoint, config.id)
+		return e.Mountpoint, e.Source, nil
+	}
+
+	entriesStr := ""
+	for _, e := range entries {
+		entriesStr += e.Source + ":" + e.Mountpoint + ", "
+	}
+	return "", "", fmt.Errorf("no mount entry found for %s among entries %s, set %s to the path at which it is mounted", config.dnsName, entriesStr, mountPathKey)
+}
+
+// checkMountpoint makes sure that none of the given file systems is mounted at the same path as fs, which happens if
+// the mount of another file system is mistaken for that of fs.
+func checkMountpoint(fileSystems []*fileSystem, fs *fileSystem) error {
+	for _, other := range fileSystems {
+		if other.mountpoint != "" && other.mountpoint == fs.mountpoint {
+			return fmt.Errorf("file systems %s and %s are both found mounted at %s, set %s to the path at which each of them is mounted", other.id, fs.id, fs.mountpoint, mountPathKey)
+		}
+	}
+
+	return nil
+}
+
+// getFileSystemListEnv reads a comma separated environment variable holding one value per configured file system.
+// If the variable isn't set, every value is empty.
+func getFileSystemListEnv(key string, count int) []string {
+	values := make([]string, count)
+
+	list := os.Getenv(key)
+	if list == "" {
+		return values
+	}
+
+	parts := strings.Split(list, ",")
+	if len(parts) != count {
+		klog.Fatalf("environment variable %s must contain a value for each of the %d file systems in %s", key, count, fileSystemIDKey)
+	}
+
+	for i, part := range parts {
+		values[i] = strings.TrimSpace(part)
+	}
+
+	return values
+}
+
+// watchMounts keeps the file systems mounted by the provisioner mounted until the context is done
+func (p *efsProvisioner) watchMounts(ctx context.Context) {
+	for _, fs := range p.fileSystems {
+		if fs.mounter != nil {
+			go fs.mounter.Watch(ctx, mountCheckInterval)
+		}
+	}
+}
+
+// unmount unmounts the file systems mounted by the provisioner
+func (p *efsProvisioner) unmount() {
+	for _, fs := range p.fileSystems {
+		if fs.mounter == nil {
+			continue
+		}
+
+		if err := fs.mounter.Unmount(); err != nil {
+			klog.Errorf("%v", err)
+		}
+	}
+}
+
+// getFileSystem returns the file system selected by the fileSystemId parameter of the storage class, or the first
+// configured file system if the parameter isn't set.
+func (p *efsProvisioner) getFileSystem(options controller.ProvisionOptions) (*fileSystem, error) {
+	id, ok := options.StorageClass.Parameters["fileSystemId"]
+	if !ok {
+		return p.fileSystems[0], nil
+	}
+
+	for _, fs := range p.fileSystems {
+		if fs.id == id {
+			return fs, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid value '%s' for parameter fileSystemId: the file system is not configured in this provisioner", id)
+}
+
+// getVolumeFileSystem determines which file system the given volume was created on and the path of its directory
+// relative to the root of that file system.  Both NFS volumes and EFS CSI volumes created by this provisioner are
+// understood.
+func (p *efsProvisioner) getVolumeFileSystem(ctx context.Context, volume *v1.PersistentVolume) (*fileSystem, string, error) {
+	switch {
+	case volume.Spec.NFS != nil:
+		nfs := volume.Spec.NFS
+		for _, fs := range p.fileSystems {
+			if nfs.Server == fs.dnsName {
+				return fs, nfs.Path, nil
+			}
+		}
+		return nil, "", fmt.Errorf("volume's NFS server %s is not one of the servers from which this provisioner creates volumes", nfs.Server)
+	case volume.Spec.CSI != nil:
+		csi := volume.Spec.CSI
+		if csi.Driver != csiDriverName {
+			return nil, "", fmt.Errorf("volume's CSI driver %s is not the %s driver for which this provisioner creates volumes", csi.Driver, csiDriverName)
+		}
+
+		fileSystemID, remotePath, accessPointID, err := parseCSIVolumeHandle(csi.VolumeHandle)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, fs := range p.fileSystems {
+			if fileSystemID != fs.id {
+				continue
+			}
+
+			if accessPointID != "" {
+				if remotePath, err = p.getAccessPointRootDir(ctx, fs, volume, accessPointID); err != nil {
+					return nil, "", err
+				}
+			}
+
+			return fs, remotePath, nil
+		}
+		return nil, "", fmt.Errorf("volume's file system %s is not one of the file systems from which this provisioner creates volumes", fileSystemID)
+	default:
+		return nil, "", fmt.Errorf("volume %s is neither an NFS nor an EFS CSI volume", volume.Name)
+	}
+}
+
+// hasVolume determines if the given volume is on this file system
+func (fs *fileSystem) hasVolume(volume *v1.PersistentVolume) bool {
+	switch {
+	case volume.Spec.NFS != nil:
+		return volume.Spec.NFS.Server == fs.dnsName
+	case volume.Spec.CSI != nil && volume.Spec.CSI.Driver == csiDriverName:
+		fileSystemID, _, _, err := parseCSIVolumeHandle(volume.Spec.CSI.VolumeHandle)
+		return err == nil && fileSystemID == fs.id
+	default:
+		return false
+	}
+}
+
+// volumeLocalPath returns the local path of the directory of the given volume on this file system.  The directory of a
+// volume mounted through an access point is only known if its PV records the root directory of the access point.
+func (fs *fileSystem) volumeLocalPath(volume *v1.PersistentVolume) (string, bool) {
+	var remotePath string
+	switch {
+	case volume.Spec.NFS != nil:
+		remotePath = volume.Spec.NFS.Path
+	case volume.Spec.CSI != nil:
+		_, subpath, accessPointID, err := parseCSIVolumeHandle(volume.Spec.CSI.VolumeHandle)
+		if err != nil {
+			return "", false
+		}
+		remotePath = subpath
+		if accessPointID != "" {
+			if remotePath = volume.Annotations[accessPointRootDirAnnotationKey]; remotePath == "" {
+				return "", false
+			}
+		}
+	default:
+		return "", false
+	}
+
+	localPath, err := fs.getLocalPathForRemotePath(remotePath)
+	if err != nil {
+		return "", false
+	}
+
+	return localPath, true
+}
+
+// getAccessPointRootDir returns the path of the root directory of the access point of the given volume relative to the
+// root of the file system.  If the access point was already deleted, e.g. by a Delete that failed afterwards, the path
+// recorded in the annotations of the volume or the directory whose volume metadata names the volume is used instead.
+func (p *efsProvisioner) getAccessPointRootDir(ctx context.Context, fs *fileSystem, volume *v1.PersistentVolume, accessPointID string) (string, error) {
+	rootDir, err := internal.DescribeAccessPointRootDir(ctx, p.efs, accessPointID)
+	if !errors.Is(err, internal.ErrAccessPointNotFound) {
+		return rootDir, err
+	}
+
+	if rootDir, ok := volume.Annotations[accessPointRootDirAnnotationKey]; ok {
+		klog.Warningf("access point %s of volume %s no longer exists, using its root directory %s recorded in the volume", accessPointID, volume.Name, rootDir)
+		return rootDir, nil
+	}
+
+	localPath, err := internal.FindVolumeByPVName(fs.mountpoint, volume.Name)
+	if err != nil {
+		return "", err
+	}
+	if localPath == "" {
+		return "", fmt.Errorf("access point %s of volume %s no longer exists and no directory on %s is recorded as its root directory", accessPointID, volume.Name, fs.id)
+	}
+
+	rootDir = path.Join(fs.sourcePath(), path.Base(localPath))
+	klog.Warningf("access point %s of volume %s no longer exists, using its root directory %s found in the volume metadata", accessPointID, volume.Name, rootDir)
+
+	return rootDir, nil
+}
+
+func (fs *fileSystem) getLocalPath(options controller.ProvisionOptions) (string, error) {
+	dirname, err := getDirectoryName(options)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(fs.mountpoint, dirname), nil
+}
+
+// getTemplatePath returns the local path of the directory given by the templateDir parameter, which is relative to
+// where the file system is mounted, or an empty string if it isn't set
+func (fs *fileSystem) getTemplatePath(parameters map[string]string) (string, error) {
+	templateDir, ok := parameters["templateDir"]
+	if !ok || templateDir == "" {
+		return "", nil
+	}
+
+	templatePath := path.Join(fs.mountpoint, templateDir)
+	if !strings.HasPrefix(templatePath, fs.mountpoint+"/") {
+		return "", fmt.Errorf("invalid value '%s' for parameter templateDir: must be a directory under the root of the provisioner on file system %s", templateDir, fs.id)
+	}
+
+	if info, err := os.Stat(templatePath); err != nil {
+		return "", fmt.Errorf("invalid value '%s' for parameter templateDir: %v", templateDir, err)
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("invalid value '%s' for parameter templateDir: %s is not a directory", templateDir, templatePath)
+	}
+
+	return templatePath, nil
+}
+
+func (fs *fileSystem) getRemotePath(options controller.ProvisionOptions) (string, error) {
+	dirname, err := getDirectoryName(options)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(fs.sourcePath(), dirname), nil
+}
+
+// getLocalPathForRemotePath translates a path relative to the root of the file system into the path at which it is
+// mounted in this provisioner.
+func (fs *fileSystem) getLocalPathForRemotePath(remotePath string) (string, error) {
+	sourcePath := fs.sourcePath()
+	if !strings.HasPrefix(remotePath, sourcePath) {
+		return "", fmt.Errorf("volume's path %s is not a child of the server path %s mounted in this provisioner at %s", remotePath, fs.source, fs.mountpoint)
+	}
+
+	subpath := strings.Replace(remotePath, sourcePath, "", 1)
+
+	return path.Join(fs.mountpoint, subpath), nil
+}
+
+// volumeSource builds the source of a PV of the given type for the directory at remotePath
+func (fs *fileSystem) volumeSource(volumeType, remotePath, accessPointID string) v1.PersistentVolumeSource {
+	if volumeType == volumeTypeCSI {
+		return csiVolumeSource(fs.id, remotePath, accessPointID)
+	}
+
+	return v1.PersistentVolumeSource{
+		NFS: &v1.NFSVolumeSource{
+			Server:   fs.dnsName,
+			Path:     remotePath,
+			ReadOnly: false,
+		},
+	}
+}
+
+// sourcePath is the path within the file system that is mounted in this provisioner.  The host part of the source
+// isn't necessarily the DNS name of the file system, e.g. efs-utils TLS mounts show the local stunnel address instead.
+func (fs *fileSystem) sourcePath() string {
+	return path.Clean("/" + fs.source[strings.Index(fs.source, ":")+1:])
+}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	gidStoreNamespaceKey = "GID_STORE_NAMESPACE"
+	gidRegistryKey       = "GID_REGISTRY"
+
+	reconcileGIDsCommand = "reconcile-gids"
+)
+
+// gidClass is a storage class of this provisioner that allocates gids from the range gidMin-gidMax on a file system
+type gidClass struct {
+	class        *storagev1.StorageClass
+	fileSystemID string
+	gidMin       int
+	gidMax       int
+	rangeSet     bool
+	allowOverlap bool
+}
+
+func (c gidClass) overlaps(other gidClass) bool {
+	return c.fileSystemID == other.fileSystemID && c.gidMin <= other.gidMax && other.gidMin <= c.gidMax
+}
+
+// refusesOverlap tells whether provisioning from the storage class is refused because its range overlaps the range of
+// the other storage class.  Only overlapping ranges that were both set explicitly are refused, since a storage class
+// without gidMin and gidMax overlaps every other one.
+func (c gidClass) refusesOverlap(other gidClass) bool {
+	return c.overlaps(other) && c.rangeSet && other.rangeSet && !c.allowOverlap
+}
+
+// allowGidRangeOverlapOption parses the allowGidRangeOverlap parameter, which lets a storage class allocate gids from a
+// range that overlaps the range of another storage class on the same file system
+func allowGidRangeOverlapOption(parameters map[string]string) (bool, error) {
+	v, ok := parameters["allowGidRangeOverlap"]
+	if !ok {
+		return false, nil
+	}
+
+	allowOverlap, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %s for parameter allowGidRangeOverlap: %v", v, err)
+	}
+
+	return allowOverlap, nil
+}
+
+// newGIDClass parses the parameters of a storage class of this provisioner, ok is false if it doesn't allocate gids
+func (p *efsProvisioner) newGIDClass(class *storagev1.StorageClass) (c gidClass, ok bool, err error) {
+	gidAllocate, err := gidAllocateOption(class.Parameters)
+	if err != nil || !gidAllocate {
+		return gidClass{}, false, err
+	}
+
+	c = gidClass{class: class, fileSystemID: p.fileSystems[0].id}
+	if id, ok := class.Parameters["fileSystemId"]; ok {
+		c.fileSystemID = id
+	}
+	if c.gidMin, c.gidMax, err = internal.GIDRange(class.Parameters); err != nil {
+		return gidClass{}, false, err
+	}
+	for k := range class.Parameters {
+		if strings.EqualFold(k, "gidMin") || strings.EqualFold(k, "gidMax") {
+			c.rangeSet = true
+		}
+	}
+	if c.allowOverlap, err = allowGidRangeOverlapOption(class.Parameters); err != nil {
+		return gidClass{}, false, err
+	}
+
+	return c, true, nil
+}
+
+// gidClasses lists the storage classes of this provisioner that allocate gids.  Storage classes with invalid parameters
+// are left out, since no volumes can be provisioned from them.
+func (p *efsProvisioner) gidClasses(ctx context.Context) ([]gidClass, error) {
+	classes, err := p.client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage classes: %v", err)
+	}
+
+	var gidClasses []gidClass
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		if class.Provisioner != p.name {
+			continue
+		}
+
+		if c, ok, err := p.newGIDClass(class); err != nil {
+			klog.Warningf("ignoring the gid range of storage class %s: %v", class.Name, err)
+		} else if ok {
+			gidClasses = append(gidClasses, c)
+		}
+	}
+
+	return gidClasses, nil
+}
+
+// sharedGIDClasses returns the names of the other storage classes that allocate gids on the same file system as the
+// storage class of the claim being provisioned, whose gids are in use on the file system as well.  Provisioning is
+// refused if the range of the storage class overlaps the explicitly set range of another unless the storage class
+// allows it.
+func (p *efsProvisioner) sharedGIDClasses(ctx context.Context, options controller.ProvisionOptions) ([]string, error) {
+	c, _, err := p.newGIDClass(options.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+
+	classes, err := p.gidClasses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []string
+	for _, other := range classes {
+		if other.class.Name == options.StorageClass.Name || other.fileSystemID != c.fileSystemID {
+			continue
+		}
+
+		if c.refusesOverlap(other) {
+			return nil, fmt.Errorf("the gid range %d-%d of storage class %s overlaps the range %d-%d of storage class %s on file system %s, set the allowGidRangeOverlap parameter to allocate gids from the shared range",
+				c.gidMin, c.gidMax, options.StorageClass.Name, other.gidMin, other.gidMax, other.class.Name, c.fileSystemID)
+		}
+
+		shared = append(shared, other.class.Name)
+	}
+
+	return shared, nil
+}
+
+// warnOverlappingGIDRanges records a warning event on every storage class whose gid range overlaps the range of
+// another storage class on the same file system
+func (p *efsProvisioner) warnOverlappingGIDRanges(ctx context.Context) {
+	classes, err := p.gidClasses(ctx)
+	if err != nil {
+		klog.Errorf("failed to check the gid ranges of storage classes: %v", err)
+		return
+	}
+
+	for _, c := range classes {
+		for _, other := range classes {
+			if c.class.Name == other.class.Name || !c.overlaps(other) {
+				continue
+			}
+
+			consequence := "the gids in use by both storage classes are skipped when allocating gids"
+			if c.refusesOverlap(other) {
+				consequence = "no volumes are provisioned from this storage class until the ranges no longer overlap or allowGidRangeOverlap is set"
+			}
+
+			klog.Warningf("the gid range %d-%d of storage class %s overlaps the range %d-%d of storage class %s on file system %s",
+				c.gidMin, c.gidMax, c.class.Name, other.gidMin, other.gidMax, other.class.Name, c.fileSystemID)
+			p.recorder.Eventf(c.class, v1.EventTypeWarning, "GIDRangeOverlap", "The gid range %d-%d overlaps the range %d-%d of storage class %s on file system %s, so %s",
+				c.gidMin, c.gidMax, other.gidMin, other.gidMax, other.class.Name, c.fileSystemID, consequence)
+		}
+	}
+}
+
+// newGIDStore creates the store of the gid tables of a file system in the namespace given by GID_STORE_NAMESPACE, or
+// returns nil if it isn't set, in which case the gid tables are only kept in memory
+func newGIDStore(client kubernetes.Interface, fileSystemID string) *internal.GIDStore {
+	namespace := os.Getenv(gidStoreNamespaceKey)
+	if namespace == "" {
+		return nil
+	}
+
+	return internal.NewGIDStore(client, namespace, fileSystemID)
+}
+
+// newGIDRegistry creates the registry of the gids allocated by every cluster sharing the file system mounted at
+// mountpoint if GID_REGISTRY is true, or returns nil.  The registry tells clusters apart by their CLUSTER_ID.
+func newGIDRegistry(mountpoint string) *internal.GIDRegistry {
+	registryStr := os.Getenv(gidRegistryKey)
+	if registryStr == "" {
+		return nil
+	}
+
+	registry, err := strconv.ParseBool(registryStr)
+	if err != nil {
+		klog.Fatalf("invalid value '%s' for environment variable %s: %v", registryStr, gidRegistryKey, err)
+	}
+	if !registry {
+		return nil
+	}
+
+	clusterID := os.Getenv(clusterIDKey)
+	if clusterID == "" {
+		klog.Fatalf("environment variable %s must be set to tell clusters apart in the gid registry", clusterIDKey)
+	}
+
+	return internal.NewGIDRegistry(mountpoint, clusterID)
+}
+
+// registerGIDs records the gids in use by every storage class of this provisioner in the registries of their file
+// systems, so that other clusters know about them before this cluster allocates or releases any gid
+func (p *efsProvisioner) registerGIDs(ctx context.Context) {
+	if os.Getenv(gidRegistryKey) == "" {
+		return
+	}
+
+	classes, err := p.gidClasses(ctx)
+	if err != nil {
+		klog.Errorf("failed to register gids: %v", err)
+		return
+	}
+
+	for _, c := range classes {
+		for _, fs := range p.fileSystems {
+			if fs.id != c.fileSystemID {
+				continue
+			}
+
+			if err := fs.allocator.Register(ctx, c.class.Name); err != nil {
+				klog.Errorf("failed to register the gids of storage class %s on %s: %v", c.class.Name, fs.id, err)
+			}
+		}
+	}
+}
+
+// reconcileGIDs compares the stored gid table of every storage class of this provisioner that allocates gids with the
+// gids actually in use by its PVs and directories, adds the gids that are missing from the stored table and, if
+// -prune is given, removes the gids that are no longer in use.
+func reconcileGIDs(args []string) {
+	flags := flag.NewFlagSet(reconcileGIDsCommand, flag.ExitOnError)
+	fileSystemID := flags.String("file-system", "", "only reconcile the gid tables of storage classes on the file system with this id")
+	className := flags.String("storage-class", "", "only reconcile the gid table of this storage class")
+	prune := flags.Bool("prune", false, "also remove gids that are no longer in use from the stored gid tables")
+	dryRun := flags.Bool("dry-run", true, "only print the differences between the stored gid tables and the gids in use")
+	flags.Parse(args)
+
+	provisionerName := os.Getenv(provisionerNameKey)
+	if provisionerName == "" {
+		klog.Fatalf("environment variable %s is not set! Please set it.", provisionerNameKey)
+	}
+	if os.Getenv(gidStoreNamespaceKey) == "" {
+		klog.Fatalf("environment variable %s is not set, so gid tables aren't stored", gidStoreNamespaceKey)
+	}
+
+	ctx := context.Background()
+	client := buildClient()
+	configureMetadataSigning(client)
+
+	_, configs := getFileSystemConfig()
+
+	// file systems the provisioner mounts itself are unmounted before exiting, whether reconciling failed or not
+	p := &efsProvisioner{name: provisionerName, client: client}
+	err := p.reconcileGIDTables(ctx, configs, *fileSystemID, *className, *prune, *dryRun)
+	p.unmount()
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+// reconcileGIDTables reconciles the gid tables of the storage classes of this provisioner that allocate gids, limited
+// to those on the file system with the given id and the storage class with the given name if they are set.  File
+// systems are only mounted once a storage class on them is reconciled.
+func (p *efsProvisioner) reconcileGIDTables(ctx context.Context, configs []fileSystemConfig, fileSystemID, className string, prune, dryRun bool) error {
+	classes, err := p.client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list storage classes: %v", err)
+	}
+
+	failed := 0
+	for _, class := range classes.Items {
+		if class.Provisioner != p.name || (className != "" && class.Name != className) {
+			continue
+		}
+
+		if gidAllocate, err := gidAllocateOption(class.Parameters); err != nil {
+			klog.Errorf("skipping storage class %s: %v", class.Name, err)
+			failed++
+			continue
+		} else if !gidAllocate {
+			continue
+		}
+
+		id, ok := class.Parameters["fileSystemId"]
+		if !ok {
+			id = configs[0].id
+		}
+		if fileSystemID != "" && id != fileSystemID {
+			continue
+		}
+
+		fs, err := p.mountFileSystem(configs, id)
+		if err != nil {
+			klog.Errorf("skipping storage class %s since its file system %s can't be set up: %v", class.Name, id, err)
+			failed++
+			continue
+		}
+		if fs == nil {
+			klog.Errorf("skipping storage class %s since its file system %s is not configured in this provisioner", class.Name, id)
+			failed++
+			continue
+		}
+
+		if err := reconcileGIDTable(ctx, fs, class.Name, prune, dryRun); err != nil {
+			klog.Errorf("failed to reconcile the gid table of storage class %s: %v", class.Name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to reconcile %d storage classes", failed)
+	}
+
+	return nil
+}
+
+// mountFileSystem returns the file system with the given id, which is set up and added to the file systems of the
+// provisioner the first time it's needed, or nil if it isn't configured
+func (p *efsProvisioner) mountFileSystem(configs []fileSystemConfig, id string) (*fileSystem, error) {
+	for _, fs := range p.fileSystems {
+		if fs.id == id {
+			return fs, nil
+		}
+	}
+
+	for _, config := range configs {
+		if config.id != id {
+			continue
+		}
+
+		fs, err := newFileSystem(p.client, config, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMountpoint(p.fileSystems, fs); err != nil {
+			return nil, err
+		}
+		p.fileSystems = append(p.fileSystems, fs)
+
+		return fs, nil
+	}
+
+	return nil, nil
+}
+
+// reconcileGIDTable reconciles the stored gid table of a storage class with the gids in use on the given file system.
+// Only gids that were stored before the gids in use were collected are pruned, so that gids allocated by a running
+// provisioner in the meantime are kept.
+func reconcileGIDTable(ctx context.Context, fs *fileSystem, className string, prune, dryRun bool) error {
+	store := fs.allocator.Store()
+
+	stored, err := store.Load(ctx, className)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		stored = internal.NewGIDTable()
+	}
+
+	inUse, err := fs.allocator.Collect(ctx, className)
+	if err != nil {
+		return err
+	}
+
+	missing, unused := inUse.Difference(stored), stored.Difference(inUse)
+
+	fmt.Printf("storage class %s on %s: %d gids in use, missing from the stored table: [%s], no longer in use: [%s]\n",
+		className, fs.id, inUse.Len(), missing, unused)
+
+	if dryRun {
+		return nil
+	}
+
+	err = store.Update(ctx, className, func() (*internal.GIDTable, error) { return inUse, nil }, func(table *internal.GIDTable) error {
+		table.Add(missing)
+		if prune {
+			table.Remove(unused)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return fs.allocator.Register(ctx, className)
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// newTestGIDClass creates a storage class of the test provisioner that allocates gids
+func newTestGIDClass(name string, parameters map[string]string) *storagev1.StorageClass {
+	parameters["gidAllocate"] = "true"
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: testProvisionerName,
+		Parameters:  parameters,
+	}
+}
+
+func TestSharedGIDClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes []runtime.Object
+		refused bool
+	}{
+		{
+			name: "default ranges",
+			classes: []runtime.Object{
+				newTestGIDClass("efs", map[string]string{}),
+				newTestGIDClass("other", map[string]string{}),
+			},
+		},
+		{
+			name: "default range and explicit range",
+			classes: []runtime.Object{
+				newTestGIDClass("efs", map[string]string{}),
+				newTestGIDClass("other", map[string]string{"gidMin": "3000", "gidMax": "3999"}),
+			},
+		},
+		{
+			name: "separate explicit ranges",
+			classes: []runtime.Object{
+				newTestGIDClass("efs", map[string]string{"gidMin": "2000", "gidMax": "2999"}),
+				newTestGIDClass("other", map[string]string{"gidMin": "3000", "gidMax": "3999"}),
+			},
+		},
+		{
+			name: "overlapping explicit ranges",
+			classes: []runtime.Object{
+				newTestGIDClass("efs", map[string]string{"gidMin": "2000", "gidMax": "3000"}),
+				newTestGIDClass("other", map[string]string{"GIDMIN": "3000", "gidMax": "3999"}),
+			},
+			refused: true,
+		},
+		{
+			name: "overlapping explicit ranges allowed",
+			classes: []runtime.Object{
+				newTestGIDClass("efs", map[string]string{"gidMin": "2000", "gidMax": "3000", "allowGidRangeOverlap": "true"}),
+				newTestGIDClass("other", map[string]string{"gidMin": "3000", "gidMax": "3999"}),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, _ := newTestProvisioner(t, test.classes...)
+			class := test.classes[0].(*storagev1.StorageClass)
+
+			shared, err := p.sharedGIDClasses(context.Background(), controller.ProvisionOptions{StorageClass: class})
+			if test.refused {
+				if err == nil {
+					t.Errorf("expected the overlapping range to be refused")
+				}
+				return
+			}
+			if err != nil || len(shared) != 1 || shared[0] != "other" {
+				t.Errorf("expected the gids to be shared with storage class other, got %v, %v", shared, err)
+			}
+		})
+	}
+}
+
+func TestReconcileGIDTablesUnreachableFileSystem(t *testing.T) {
+	p, _ := newTestProvisioner(t,
+		newTestGIDClass("broken", map[string]string{"fileSystemId": "fs-2"}),
+		newTestGIDClass("efs", map[string]string{}),
+	)
+	fs := p.fileSystems[0]
+	store := internal.NewGIDStore(p.client, "default", fs.id)
+	fs.allocator = internal.NewGIDAllocator(p.client, internal.NewFileSystemReclaimer(fs.mountpoint), store, nil)
+
+	// nothing is mounted where the second file system is configured
+	configs := []fileSystemConfig{
+		{id: testFileSystemID, dnsName: testDNSName, mountpoint: fs.mountpoint},
+		{id: "fs-2", dnsName: "fs-2.efs.us-east-1.amazonaws.com", mountpoint: t.TempDir()},
+	}
+
+	ctx := context.Background()
+	err := p.reconcileGIDTables(ctx, configs, "", "", false, false)
+	if err == nil || !strings.Contains(err.Error(), "failed to reconcile 1 storage classes") {
+		t.Errorf("expected only the storage class on the unreachable file system to fail, got %v", err)
+	}
+	if table, err := store.Load(ctx, "efs"); err != nil || table == nil {
+		t.Errorf("expected the gid table of storage class efs to be reconciled, got %v, %v", table, err)
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+const (
+	clusterIDKey = "CLUSTER_ID"
+
+	metadataSigningSecretKey = "METADATA_SIGNING_SECRET"
+	allowUnsignedMetadataKey = "ALLOW_UNSIGNED_METADATA"
+
+	// metadataSigningSecretDataKey is the entry of the metadata signing secret that holds the key
+	metadataSigningSecretDataKey = "key"
+)
+
+// version is set at build time with -ldflags "-X github.com/OneCause/efs-provisioner/cmd.version=..."
+var version = "dev"
+
+// configureMetadataSigning enables signing of volume metadata with the key in the secret METADATA_SIGNING_SECRET,
+// given as namespace/name.  Unsigned metadata is only accepted if ALLOW_UNSIGNED_METADATA is true.
+func configureMetadataSigning(client kubernetes.Interface) {
+	secretRef := os.Getenv(metadataSigningSecretKey)
+	if secretRef == "" {
+		return
+	}
+
+	namespace, name, ok := strings.Cut(secretRef, "/")
+	if !ok || namespace == "" || name == "" {
+		klog.Fatalf("invalid value '%s' for environment variable %s: must be namespace/name", secretRef, metadataSigningSecretKey)
+	}
+
+	allowUnsigned := false
+	if allowUnsignedStr := os.Getenv(allowUnsignedMetadataKey); allowUnsignedStr != "" {
+		var err error
+		if allowUnsigned, err = strconv.ParseBool(allowUnsignedStr); err != nil {
+			klog.Fatalf("invalid value '%s' for environment variable %s: %v", allowUnsignedStr, allowUnsignedMetadataKey, err)
+		}
+	}
+
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("failed to get metadata signing secret %s: %v", secretRef, err)
+	}
+
+	key := secret.Data[metadataSigningSecretDataKey]
+	if len(key) == 0 {
+		klog.Fatalf("metadata signing secret %s has no %s", secretRef, metadataSigningSecretDataKey)
+	}
+
+	internal.SetMetadataSigningKey(key, allowUnsigned)
+
+	klog.Infof("signing volume metadata with the key in secret %s", secretRef)
+}
+
+// newVolumeMetadata describes the directory of a new volume and where it was created
+func (p *efsProvisioner) newVolumeMetadata(options controller.ProvisionOptions, gid, uid string, mode os.FileMode) internal.VolumeMetadata {
+	now := time.Now().UTC()
+
+	md := internal.VolumeMetadata{
+		SchemaVersion:      internal.VolumeMetadataSchemaVersion,
+		GID:                gid,
+		PVCName:            options.PVC.Name,
+		PVCNamespace:       options.PVC.Namespace,
+		StorageClassName:   util.GetPersistentVolumeClaimClass(options.PVC),
+		UID:                uid,
+		Mode:               internal.FormatMode(mode),
+		CreatedAt:          &now,
+		Provisioner:        p.name,
+		ProvisionerVersion: version,
+		ClusterID:          os.Getenv(clusterIDKey),
+	}
+	recordVolumeBinding(&md, options)
+
+	return md
+}
+
+// recordVolumeBinding records that the directory is provisioned for the PV and PVC of the given options.  A binding
+// that is already the latest one isn't recorded again, since Provision may be retried.
+func recordVolumeBinding(md *internal.VolumeMetadata, options controller.ProvisionOptions) {
+	md.SchemaVersion = internal.VolumeMetadataSchemaVersion
+	md.PVName = options.PVName
+	md.PVCUID = string(options.PVC.UID)
+	md.PVCLabels = options.PVC.Labels
+
+	if len(md.History) > 0 && md.History[len(md.History)-1].PVName == options.PVName {
+		return
+	}
+
+	md.History = append(md.History, internal.VolumeBinding{
+		PVName:        options.PVName,
+		PVCName:       options.PVC.Name,
+		PVCNamespace:  options.PVC.Namespace,
+		PVCUID:        string(options.PVC.UID),
+		ProvisionedAt: time.Now().UTC(),
+	})
+}
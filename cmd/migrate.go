@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	migrateToCSICommand = "migrate-to-csi"
+
+	provisionedByAnnotationKey = "pv.kubernetes.io/provisioned-by"
+)
+
+// migrateToCSI converts the NFS PVs created by this provisioner into equivalent EFS CSI PVs.  Since the volume source
+// of a PV is immutable, each PV is deleted and recreated with the same name, claimRef and annotations.  A bound claim
+// is briefly reported as Lost until the new PV appears, at which point it is bound again.  Pods that already have the
+// volume mounted keep using their NFS mount until they are restarted.
+func migrateToCSI(args []string) {
+	flags := flag.NewFlagSet(migrateToCSICommand, flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", true, "only print the changes that would be made to each PV")
+	pvName := flags.String("pv", "", "only migrate the PV with this name")
+	mountOptions := flags.String("mount-options", strings.Join(defaultCSIMountOptions, ","), "comma separated mount options to set on the migrated PVs")
+	backupDir := flags.String("backup-dir", "", "the directory to save the original and migrated manifest of each PV in before it is replaced (defaults to printing them)")
+	flags.Parse(args)
+
+	provisionerName := os.Getenv(provisionerNameKey)
+	if provisionerName == "" {
+		klog.Fatalf("environment variable %s is not set! Please set it.", provisionerNameKey)
+	}
+	_, configs := getFileSystemConfig()
+
+	fileSystemIDs := map[string]string{}
+	for _, config := range configs {
+		fileSystemIDs[config.dnsName] = config.id
+	}
+
+	var csiMountOptions []string
+	if *mountOptions != "" {
+		csiMountOptions = strings.Split(*mountOptions, ",")
+	}
+
+	ctx := context.Background()
+	client := buildClient()
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Fatalf("failed to list PVs: %v", err)
+	}
+
+	failed := 0
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+
+		if *pvName != "" && pv.Name != *pvName {
+			continue
+		}
+		if pv.Annotations[provisionedByAnnotationKey] != provisionerName || pv.Spec.NFS == nil {
+			continue
+		}
+		fileSystemID, ok := fileSystemIDs[pv.Spec.NFS.Server]
+		if !ok {
+			klog.Warningf("skipping %s since its NFS server %s is not one of the configured file systems", pv.Name, pv.Spec.NFS.Server)
+			continue
+		}
+
+		migrated := csiPersistentVolume(pv, fileSystemID, csiMountOptions)
+
+		diff, err := diffPersistentVolumes(pv, migrated)
+		if err != nil {
+			klog.Errorf("failed to compute changes for %s: %v", pv.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("--- %s (nfs)\n+++ %s (csi)\n%s\n", pv.Name, pv.Name, diff)
+
+		if *dryRun {
+			continue
+		}
+
+		// the manifests are the only way to recreate a PV by hand if it can't be restored after it was deleted
+		if err := saveManifests(*backupDir, pv, migrated); err != nil {
+			klog.Errorf("not migrating %s since its manifests couldn't be saved: %v", pv.Name, err)
+			failed++
+			continue
+		}
+
+		if err := replacePersistentVolume(ctx, client, pv, migrated); err != nil {
+			klog.Errorf("failed to migrate %s: %v", pv.Name, err)
+			failed++
+			continue
+		}
+
+		klog.Infof("migrated %s to the %s driver", pv.Name, csiDriverName)
+	}
+
+	if failed > 0 {
+		klog.Fatalf("failed to migrate %d PVs", failed)
+	}
+}
+
+// recreatablePersistentVolume copies the name, labels, annotations and spec of a PV into a new PV that can be created
+// in its place once it is deleted
+func recreatablePersistentVolume(pv *v1.PersistentVolume) *v1.PersistentVolume {
+	recreated := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+
+	if recreated.Spec.ClaimRef != nil {
+		recreated.Spec.ClaimRef.ResourceVersion = ""
+	}
+
+	return recreated
+}
+
+// csiPersistentVolume builds the EFS CSI equivalent of an NFS PV created by this provisioner.
+func csiPersistentVolume(pv *v1.PersistentVolume, fileSystemID string, mountOptions []string) *v1.PersistentVolume {
+	migrated := recreatablePersistentVolume(pv)
+
+	migrated.Spec.PersistentVolumeSource = csiVolumeSource(fileSystemID, pv.Spec.NFS.Path, pv.Annotations[accessPointIDAnnotationKey])
+	migrated.Spec.MountOptions = mountOptions
+
+	return migrated
+}
+
+// saveManifests writes the manifests of the original and the migrated PV to [name].orig.yaml and [name].csi.yaml in
+// backupDir, or prints them if backupDir is empty
+func saveManifests(backupDir string, pv, migrated *v1.PersistentVolume) error {
+	for _, manifest := range []struct {
+		suffix string
+		pv     *v1.PersistentVolume
+	}{{"orig", recreatablePersistentVolume(pv)}, {"csi", migrated}} {
+		out, err := yaml.Marshal(manifest.pv)
+		if err != nil {
+			return err
+		}
+
+		if backupDir == "" {
+			fmt.Printf("# %s (%s)\n---\n%s", pv.Name, manifest.suffix, out)
+			continue
+		}
+
+		manifestPath := path.Join(backupDir, pv.Name+"."+manifest.suffix+".yaml")
+		if err := os.WriteFile(manifestPath, out, 0600); err != nil {
+			return err
+		}
+		klog.Infof("saved the %s manifest of %s to %s", manifest.suffix, pv.Name, manifestPath)
+	}
+
+	return nil
+}
+
+// replacePersistentVolume deletes the given PV and creates the migrated one in its place.  The reclaim policy of the
+// old PV is set to Retain first so that the directory backing it can never be deleted during the migration.  If the
+// migration fails, the original PV is restored with its original reclaim policy.
+func replacePersistentVolume(ctx context.Context, client kubernetes.Interface, pv, migrated *v1.PersistentVolume) (err error) {
+	pvs := client.CoreV1().PersistentVolumes()
+
+	retained, deleted := false, false
+	defer func() {
+		if err != nil && (retained || deleted) {
+			if restoreErr := restorePersistentVolume(ctx, client, pv, deleted); restoreErr != nil {
+				err = fmt.Errorf("%v, and restoring the original PV failed, it must be recreated by hand from its saved manifest: %v", err, restoreErr)
+			}
+		}
+	}()
+
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		patch := fmt.Sprintf(`{"spec":{"persistentVolumeReclaimPolicy":"%s"}}`, v1.PersistentVolumeReclaimRetain)
+		if _, err := pvs.Patch(ctx, pv.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to set the reclaim policy to %s: %v", v1.PersistentVolumeReclaimRetain, err)
+		}
+		retained = true
+	}
+
+	// the pv-protection finalizer would keep a bound PV around forever
+	if _, err := pvs.Patch(ctx, pv.Name, types.MergePatchType, []byte(`{"metadata":{"finalizers":null}}`), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to remove finalizers: %v", err)
+	}
+
+	if err := pvs.Delete(ctx, pv.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pv.UID}}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete: %v", err)
+	}
+	deleted = true
+
+	err = wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+		_, err := pvs.Get(ctx, pv.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for the old PV to be deleted: %v", err)
+	}
+
+	if _, err := pvs.Create(ctx, migrated, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create the migrated PV: %v", err)
+	}
+
+	return nil
+}
+
+// restorePersistentVolume undoes a failed migration of a PV.  If the PV was deleted it is recreated as it was, and if
+// it still exists, or is still being deleted, its reclaim policy is set back to the original one.
+func restorePersistentVolume(ctx context.Context, client kubernetes.Interface, pv *v1.PersistentVolume, deleted bool) error {
+	pvs := client.CoreV1().PersistentVolumes()
+
+	if deleted {
+		_, err := pvs.Create(ctx, recreatablePersistentVolume(pv), metav1.CreateOptions{})
+		if err == nil {
+			klog.Infof("recreated the original PV %s", pv.Name)
+			return nil
+		} else if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to recreate the original PV: %v", err)
+		}
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"persistentVolumeReclaimPolicy":"%s"}}`, pv.Spec.PersistentVolumeReclaimPolicy)
+	if _, err := pvs.Patch(ctx, pv.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set the reclaim policy back to %s: %v", pv.Spec.PersistentVolumeReclaimPolicy, err)
+	}
+	klog.Infof("set the reclaim policy of %s back to %s", pv.Name, pv.Spec.PersistentVolumeReclaimPolicy)
+
+	return nil
+}
+
+// diffPersistentVolumes renders the spec of both PVs as YAML and returns a diff of them.
+func diffPersistentVolumes(before, after *v1.PersistentVolume) (string, error) {
+	oldYAML, err := yaml.Marshal(before.Spec)
+	if err != nil {
+		return "", err
+	}
+	newYAML, err := yaml.Marshal(after.Spec)
+	if err != nil {
+		return "", err
+	}
+
+	return diffLines(strings.Split(string(oldYAML), "\n"), strings.Split(string(newYAML), "\n")), nil
+}
+
+// diffLines produces a minimal line based diff of a and b using their longest common subsequence.
+func diffLines(a, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+
+	return sb.String()
+}
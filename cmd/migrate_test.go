@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b     []string
+		expected string
+	}{
+		{a: nil, b: nil, expected: ""},
+		{a: []string{"a", "b"}, b: []string{"a", "b"}, expected: "  a\n  b\n"},
+		{a: []string{"a", "b", "c"}, b: []string{"a", "c"}, expected: "  a\n- b\n  c\n"},
+		{a: []string{"a", "c"}, b: []string{"a", "b", "c"}, expected: "  a\n+ b\n  c\n"},
+		{a: []string{"nfs:", "  path: /x"}, b: []string{"csi:", "  path: /x"}, expected: "- nfs:\n+ csi:\n    path: /x\n"},
+	}
+
+	for _, test := range tests {
+		if diff := diffLines(test.a, test.b); diff != test.expected {
+			t.Errorf("diff of %q and %q is\n%s\ninstead of\n%s", test.a, test.b, diff, test.expected)
+		}
+	}
+}
+
+func newTestNFSPersistentVolume() *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pvc-1",
+			UID:         "1",
+			Annotations: map[string]string{provisionedByAnnotationKey: testProvisionerName},
+			Finalizers:  []string{"kubernetes.io/pv-protection"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Server: testDNSName, Path: "/data-pvc-1"},
+			},
+		},
+	}
+}
+
+func TestReplacePersistentVolume(t *testing.T) {
+	pv := newTestNFSPersistentVolume()
+	client := fake.NewSimpleClientset(pv)
+	migrated := csiPersistentVolume(pv, testFileSystemID, defaultCSIMountOptions)
+
+	if err := replacePersistentVolume(context.Background(), client, pv, migrated); err != nil {
+		t.Fatalf("replacePersistentVolume failed: %v", err)
+	}
+
+	replaced, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the migrated PV: %v", err)
+	}
+	if replaced.Spec.CSI == nil || replaced.Spec.CSI.VolumeHandle != testFileSystemID+":/data-pvc-1" {
+		t.Errorf("expected a CSI volume for %s:/data-pvc-1, got %+v", testFileSystemID, replaced.Spec.PersistentVolumeSource)
+	}
+	if replaced.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		t.Errorf("expected the reclaim policy %s, got %s", v1.PersistentVolumeReclaimDelete, replaced.Spec.PersistentVolumeReclaimPolicy)
+	}
+}
+
+func TestReplacePersistentVolumeRestoresOriginal(t *testing.T) {
+	pv := newTestNFSPersistentVolume()
+	client := fake.NewSimpleClientset(pv)
+	client.PrependReactor("create", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.CreateAction).GetObject().(*v1.PersistentVolume).Spec.CSI != nil {
+			return true, nil, errors.New("create refused")
+		}
+		return false, nil, nil
+	})
+	migrated := csiPersistentVolume(pv, testFileSystemID, defaultCSIMountOptions)
+
+	if err := replacePersistentVolume(context.Background(), client, pv, migrated); err == nil {
+		t.Fatalf("expected replacePersistentVolume to fail")
+	}
+
+	restored, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the original PV to be restored: %v", err)
+	}
+	if restored.Spec.NFS == nil || restored.Spec.NFS.Path != "/data-pvc-1" {
+		t.Errorf("expected the original NFS volume source, got %+v", restored.Spec.PersistentVolumeSource)
+	}
+	if restored.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		t.Errorf("expected the original reclaim policy %s, got %s", v1.PersistentVolumeReclaimDelete, restored.Spec.PersistentVolumeReclaimPolicy)
+	}
+}
+
+func TestSaveManifests(t *testing.T) {
+	pv := newTestNFSPersistentVolume()
+	migrated := csiPersistentVolume(pv, testFileSystemID, defaultCSIMountOptions)
+	backupDir := t.TempDir()
+
+	if err := saveManifests(backupDir, pv, migrated); err != nil {
+		t.Fatalf("saveManifests failed: %v", err)
+	}
+
+	for suffix, source := range map[string]string{"orig": "nfs:", "csi": "csi:"} {
+		manifest, err := os.ReadFile(path.Join(backupDir, pv.Name+"."+suffix+".yaml"))
+		if err != nil {
+			t.Fatalf("failed to read the %s manifest: %v", suffix, err)
+		}
+		if !strings.Contains(string(manifest), "kind: PersistentVolume") || !strings.Contains(string(manifest), source) {
+			t.Errorf("the %s manifest is not a PV with a %s volume source:\n%s", suffix, source, manifest)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+const (
+	quotaActionNone     = "none"
+	quotaActionReadOnly = "readOnly"
+
+	// quotaReadOnlyAnnotationKey holds the original mode of the directory of a volume that was made read-only for
+	// exceeding its capacity
+	quotaReadOnlyAnnotationKey = "efs.onecause.com/quota-read-only"
+)
+
+var quotaExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "efs_provisioner_volume_quota_exceeded",
+	Help: "Whether the directory of a volume uses more than the capacity of the volume.",
+}, []string{"namespace", "persistentvolumeclaim", "storageclass"})
+
+func init() {
+	prometheus.MustRegister(quotaExceeded)
+}
+
+func quotaActionOption(parameters map[string]string) (string, error) {
+	quotaAction, ok := parameters["quotaAction"]
+	if !ok {
+		return quotaActionNone, nil
+	}
+
+	switch quotaAction {
+	case quotaActionNone, quotaActionReadOnly:
+		return quotaAction, nil
+	default:
+		return "", fmt.Errorf("invalid value '%s' for parameter quotaAction: must be %s or %s", quotaAction, quotaActionNone, quotaActionReadOnly)
+	}
+}
+
+// quotaActionForClass returns the quotaAction parameter of the given storage class.  Nothing is done to volumes whose
+// storage class is gone or invalid.
+func (p *efsProvisioner) quotaActionForClass(ctx context.Context, className string) string {
+	if className == "" {
+		return quotaActionNone
+	}
+
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("failed to get storage class %s: %v", className, err)
+		return quotaActionNone
+	}
+
+	quotaAction, err := quotaActionOption(class.Parameters)
+	if err != nil {
+		klog.Warningf("storage class %s: %v", className, err)
+		return quotaActionNone
+	}
+
+	return quotaAction
+}
+
+// checkQuota compares the usage of the directory of the given volume to its capacity, reports volumes that start to
+// exceed it on their claim and makes or unmakes their directory read-only according to the quota action.  wasExceeded
+// is whether the volume exceeded its capacity when it was last checked, and whether it does now is returned.
+func (p *efsProvisioner) checkQuota(ctx context.Context, volume *v1.PersistentVolume, volumePath string, usage internal.Usage, quotaAction string, wasExceeded bool) (bool, error) {
+	capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]
+	if !ok || capacity.Value() <= 0 {
+		return false, nil
+	}
+
+	claim := volume.Spec.ClaimRef
+	exceeded := usage.Bytes > capacity.Value()
+
+	gauge := quotaExceeded.WithLabelValues(claim.Namespace, claim.Name, util.GetPersistentVolumeClass(volume))
+	if exceeded {
+		gauge.Set(1)
+	} else {
+		gauge.Set(0)
+	}
+
+	if exceeded && !wasExceeded {
+		p.recorder.Eventf(claim, v1.EventTypeWarning, "QuotaExceeded", "Volume %s uses %s, which exceeds its capacity of %s", volume.Name, resource.NewQuantity(usage.Bytes, resource.BinarySI), capacity.String())
+	}
+
+	originalMode, readOnly := volume.Annotations[quotaReadOnlyAnnotationKey]
+
+	switch enforce := exceeded && quotaAction == quotaActionReadOnly; {
+	case enforce && !readOnly:
+		mode, err := internal.MakeReadOnly(volumePath)
+		if err != nil {
+			return exceeded, err
+		}
+		if err := p.patchVolumeAnnotations(ctx, volume.Name, map[string]*string{quotaReadOnlyAnnotationKey: &mode}); err != nil {
+			// the annotation is the only record of the original mode
+			internal.RestoreMode(volumePath, mode)
+			return exceeded, err
+		}
+		klog.Infof("made %s read-only since volume %s exceeds its capacity", volumePath, volume.Name)
+		p.recorder.Eventf(claim, v1.EventTypeWarning, "QuotaEnforced", "Volume %s was made read-only since it exceeds its capacity of %s", volume.Name, capacity.String())
+	case !enforce && readOnly:
+		if err := internal.RestoreMode(volumePath, originalMode); err != nil {
+			return exceeded, err
+		}
+		if err := p.patchVolumeAnnotations(ctx, volume.Name, map[string]*string{quotaReadOnlyAnnotationKey: nil}); err != nil {
+			return exceeded, err
+		}
+		klog.Infof("made %s writable again", volumePath)
+		p.recorder.Eventf(claim, v1.EventTypeNormal, "QuotaLifted", "Volume %s is writable again", volume.Name)
+	}
+
+	return exceeded, nil
+}
+
+// patchVolumeAnnotations sets the given annotations of a PV, removing those whose value is nil
+func (p *efsProvisioner) patchVolumeAnnotations(ctx context.Context, pvName string, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.client.CoreV1().PersistentVolumes().Patch(ctx, pvName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to annotate PV %s: %v", pvName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckQuotaReportsChanges(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	recorder := p.recorder.(*record.FakeRecorder)
+
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:         v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Ki")},
+			ClaimRef:         &v1.ObjectReference{Namespace: "default", Name: "data"},
+			StorageClassName: "efs",
+		},
+	}
+	volumePath := t.TempDir()
+
+	wasExceeded := false
+	for i, usage := range []int64{2048, 4096, 512, 2048} {
+		exceeded, err := p.checkQuota(context.Background(), volume, volumePath, internal.Usage{Bytes: usage}, quotaActionNone, wasExceeded)
+		if err != nil {
+			t.Fatalf("checkQuota failed: %v", err)
+		}
+		if exceeded != (usage > 1024) {
+			t.Errorf("scan %d: expected exceeded to be %v, got %v", i, usage > 1024, exceeded)
+		}
+
+		events := len(recorder.Events)
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+		if expected := exceeded && !wasExceeded; (events > 0) != expected {
+			t.Errorf("scan %d: expected a QuotaExceeded event to be emitted: %v, got %d events", i, expected, events)
+		}
+
+		wasExceeded = exceeded
+	}
+}
@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	restoreCommand = "restore"
+)
+
+// restore creates a PV for an archived or retained volume directory that is pre-bound to the given PVC, so that the
+// data can be recovered after the PVC was accidentally deleted.  Archived directories are moved back out of the
+// archive first.  The GID of the PV is taken from the volume metadata of the directory.
+func restore(args []string) {
+	flags := flag.NewFlagSet(restoreCommand, flag.ExitOnError)
+	dir := flags.String("dir", "", "the directory to restore relative to where the file system is mounted, e.g. .archive/data-web-0-default-20240101T000000Z")
+	fileSystemID := flags.String("file-system", "", "the id of the file system the directory is on (defaults to the first configured file system)")
+	claim := flags.String("pvc", "", "the namespace/name of the PVC to pre-bind the PV to")
+	pvName := flags.String("pv", "", "the name of the PV to create (defaults to restored-[directory name])")
+	className := flags.String("storage-class", "", "the storage class of the PV (defaults to the storage class in the volume metadata)")
+	capacity := flags.String("capacity", "1Mi", "the capacity of the PV")
+	accessModes := flags.String("access-modes", string(v1.ReadWriteMany), "comma separated access modes of the PV")
+	reclaimPolicy := flags.String("reclaim-policy", string(v1.PersistentVolumeReclaimRetain), "the reclaim policy of the PV")
+	volumeType := flags.String("volume-type", volumeTypeNFS, "the type of PV to create, nfs or csi")
+	dryRun := flags.Bool("dry-run", false, "only print the PV that would be created without moving the directory or creating the PV")
+	flags.Parse(args)
+
+	if *dir == "" {
+		klog.Fatalf("-dir is required")
+	}
+
+	claimNamespace, claimName, ok := strings.Cut(*claim, "/")
+	if !ok || claimNamespace == "" || claimName == "" {
+		klog.Fatalf("-pvc must be given as namespace/name")
+	}
+
+	if *volumeType != volumeTypeNFS && *volumeType != volumeTypeCSI {
+		klog.Fatalf("-volume-type must be %s or %s", volumeTypeNFS, volumeTypeCSI)
+	}
+
+	storage, err := resource.ParseQuantity(*capacity)
+	if err != nil {
+		klog.Fatalf("invalid value '%s' for -capacity: %v", *capacity, err)
+	}
+
+	provisionerName := os.Getenv(provisionerNameKey)
+	if provisionerName == "" {
+		klog.Fatalf("environment variable %s is not set! Please set it.", provisionerNameKey)
+	}
+
+	ctx := context.Background()
+	client := buildClient()
+	configureMetadataSigning(client)
+
+	p, fs, err := newRestoreProvisioner(client, provisionerName, *fileSystemID, *dryRun)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	// a file system the provisioner mounts itself is unmounted before exiting, whether restoring failed or not
+	err = p.restoreVolume(ctx, fs, restoreOptions{
+		dir:            *dir,
+		claimNamespace: claimNamespace,
+		claimName:      claimName,
+		pvName:         *pvName,
+		className:      *className,
+		capacity:       storage,
+		accessModes:    *accessModes,
+		reclaimPolicy:  *reclaimPolicy,
+		volumeType:     *volumeType,
+		dryRun:         *dryRun,
+	})
+	p.unmount()
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+// restoreOptions are the options of the restore command
+type restoreOptions struct {
+	dir            string
+	claimNamespace string
+	claimName      string
+	pvName         string
+	className      string
+	capacity       resource.Quantity
+	accessModes    string
+	reclaimPolicy  string
+	volumeType     string
+	dryRun         bool
+}
+
+// restoreVolume creates the PV for the directory to restore on the given file system
+func (p *efsProvisioner) restoreVolume(ctx context.Context, fs *fileSystem, options restoreOptions) error {
+	// the PV is created for the top level directory the volume is restored to, so nested directories such as
+	// snapshots can't be restored
+	volumePath := path.Join(fs.mountpoint, options.dir)
+	archived := path.Dir(volumePath) == path.Join(fs.mountpoint, internal.ArchiveDir)
+	if (!archived && path.Dir(volumePath) != fs.mountpoint) || strings.HasPrefix(path.Base(volumePath), ".") {
+		return fmt.Errorf("%s is neither a volume directory nor an archived volume directory under %s", options.dir, fs.mountpoint)
+	}
+
+	exists, existingGID, err := internal.VolumeExists(volumePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s does not exist", volumePath)
+	}
+
+	md, err := internal.ReadVolumeMetadata(volumePath)
+	if err != nil {
+		return fmt.Errorf("failed to read volume metadata for %s: %v", volumePath, err)
+	}
+	if md == nil {
+		if archived {
+			return fmt.Errorf("%s has no volume metadata recording where it was archived from", volumePath)
+		}
+		klog.Warningf("%s has no volume metadata, using the gid %d of the directory", volumePath, existingGID)
+		md = &internal.VolumeMetadata{GID: strconv.FormatUint(uint64(existingGID), 10)}
+	}
+
+	if archived != (md.ArchivedAt != nil) {
+		return fmt.Errorf("the volume metadata of %s contradicts whether it is archived", volumePath)
+	}
+	if archived && (md.ArchivedFrom == "" || md.ArchivedFrom != path.Base(md.ArchivedFrom) || strings.HasPrefix(md.ArchivedFrom, ".")) {
+		return fmt.Errorf("the volume metadata of %s records an invalid directory '%s' it was archived from", volumePath, md.ArchivedFrom)
+	}
+
+	className := options.className
+	if className == "" {
+		className = md.StorageClassName
+	}
+	if className == "" {
+		return fmt.Errorf("the volume metadata of %s has no storage class, -storage-class is required", volumePath)
+	}
+
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get storage class %s: %v", className, err)
+	}
+
+	if classFS, err := p.getFileSystem(controller.ProvisionOptions{StorageClass: class}); err != nil {
+		return err
+	} else if classFS != fs {
+		return fmt.Errorf("storage class %s provisions volumes from file system %s instead of %s", className, classFS.id, fs.id)
+	}
+
+	// the access point of the volume was deleted along with its PV, and a PV without one would lose the uid and gid
+	// the access point enforced
+	if provisioningMode, err := provisioningModeOption(controller.ProvisionOptions{StorageClass: class}); err != nil {
+		return err
+	} else if provisioningMode == provisioningModeAccessPoint {
+		return fmt.Errorf("cannot restore %s with storage class %s since it has provisioningMode %s and restore can't create access points", volumePath, className, provisioningModeAccessPoint)
+	}
+
+	if err := internal.ValidateRestoredVolume(class.Parameters, md, volumePath, existingGID); err != nil {
+		return err
+	}
+
+	if md.GID != "" {
+		if err := p.checkGIDNotInUse(ctx, fs, volumePath, md.GID); err != nil {
+			return err
+		}
+	}
+
+	dirname := path.Base(volumePath)
+	if archived {
+		dirname = md.ArchivedFrom
+	}
+
+	pvName := options.pvName
+	if pvName == "" {
+		pvName = strings.ToLower("restored-" + dirname)
+	}
+
+	annotations := map[string]string{
+		provisionedByAnnotationKey: p.name,
+	}
+	if md.GID != "" {
+		annotations[gidallocator.VolumeGidAnnotationKey] = md.GID
+	}
+	if md.UID != "" {
+		annotations[uidAnnotationKey] = md.UID
+	}
+
+	var modes []v1.PersistentVolumeAccessMode
+	for _, mode := range strings.Split(options.accessModes, ",") {
+		modes = append(modes, v1.PersistentVolumeAccessMode(mode))
+	}
+
+	mountOptions := defaultNFSMountOptions
+	if options.volumeType == volumeTypeCSI {
+		mountOptions = defaultCSIMountOptions
+	}
+	if class.MountOptions != nil {
+		mountOptions = class.MountOptions
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvName,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimPolicy(options.reclaimPolicy),
+			AccessModes:                   modes,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): options.capacity,
+			},
+			PersistentVolumeSource: fs.volumeSource(options.volumeType, path.Join(fs.sourcePath(), dirname), ""),
+			MountOptions:           mountOptions,
+			StorageClassName:       className,
+			ClaimRef: &v1.ObjectReference{
+				Kind:      "PersistentVolumeClaim",
+				Namespace: options.claimNamespace,
+				Name:      options.claimName,
+			},
+		},
+	}
+
+	if options.dryRun {
+		out, err := yaml.Marshal(pv)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+	}
+
+	// the gids of retained volumes and of volumes archived by this provisioner are still allocated, but older versions
+	// released the gid of a volume when they archived it.  It's reserved again before the directory is moved back,
+	// since its volume metadata would otherwise count as allocating it.
+	reserved := false
+	if archived && md.GID != "" {
+		sharedClassNames, err := p.sharedGIDClasses(ctx, controller.ProvisionOptions{StorageClass: class})
+		if err != nil {
+			return err
+		}
+
+		gid, _ := md.GidAsUInt()
+		err = fs.allocator.Reserve(ctx, className, int(gid), sharedClassNames)
+		if err != nil && !errors.Is(err, internal.ErrGIDAllocated) {
+			return fmt.Errorf("failed to reserve gid %s for storage class %s: %v", md.GID, className, err)
+		}
+		reserved = err == nil
+	}
+
+	if archived {
+		if _, err := internal.RestoreArchivedVolume(volumePath, md); err != nil {
+			if !reserved {
+				return err
+			}
+			if err := fs.allocator.Release(ctx, pv); err != nil {
+				klog.Errorf("failed to release gid %s of storage class %s: %v", md.GID, className, err)
+			}
+			return err
+		}
+	}
+
+	if _, err := p.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create PV %s: %v", pv.Name, err)
+	}
+
+	klog.Infof("created PV %s for %s pre-bound to %s/%s", pv.Name, path.Join(fs.mountpoint, dirname), options.claimNamespace, options.claimName)
+
+	return nil
+}
+
+// newRestoreProvisioner creates a provisioner for restoring a directory on the configured file system with the given
+// id, or the first one if no id is given, and returns that file system.  Only that file system is mounted, the others
+// are only needed to tell which file system each storage class provisions volumes from.  A dry run doesn't migrate the
+// volume metadata of the file system, since it must not change anything.
+func newRestoreProvisioner(client kubernetes.Interface, provisionerName, fileSystemID string, dryRun bool) (*efsProvisioner, *fileSystem, error) {
+	_, configs := getFileSystemConfig()
+
+	p := &efsProvisioner{name: provisionerName, client: client}
+	var restoreFS *fileSystem
+
+	for _, config := range configs {
+		if restoreFS != nil || (fileSystemID != "" && config.id != fileSystemID) {
+			p.fileSystems = append(p.fileSystems, &fileSystem{id: config.id, dnsName: config.dnsName})
+			continue
+		}
+
+		fs, err := newFileSystem(client, config, !dryRun)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.fileSystems = append(p.fileSystems, fs)
+		restoreFS = fs
+	}
+
+	if restoreFS == nil {
+		return nil, nil, fmt.Errorf("file system %s is not configured in this provisioner", fileSystemID)
+	}
+
+	return p, restoreFS, nil
+}
+
+// checkGIDNotInUse makes sure that neither a PV on the file system nor a directory on it other than the one at
+// volumePath was allocated the given GID, whatever their storage class or cluster.  The GID of an archived volume was
+// released when it was archived, so it may already have been allocated to a new volume.  The released PV that retained
+// the directory at volumePath still has its GID, but the directory can only be restored once that PV is released.
+func (p *efsProvisioner) checkGIDNotInUse(ctx context.Context, fs *fileSystem, volumePath, gid string) error {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if !fs.hasVolume(pv) {
+			continue
+		}
+
+		if localPath, ok := fs.volumeLocalPath(pv); ok && localPath == volumePath {
+			if pv.Status.Phase != v1.VolumeReleased {
+				return fmt.Errorf("%s is still the directory of PV %s, which is %s", volumePath, pv.Name, pv.Status.Phase)
+			}
+			klog.Infof("ignoring the gid of PV %s, which retained %s, delete it once the restored PV is bound", pv.Name, volumePath)
+			continue
+		}
+
+		if pv.Annotations[gidallocator.VolumeGidAnnotationKey] == gid {
+			return fmt.Errorf("gid %s is already in use by PV %s of storage class %s on file system %s", gid, pv.Name, util.GetPersistentVolumeClass(pv), fs.id)
+		}
+	}
+
+	dirs, err := internal.FindVolumesByGID(fs.mountpoint, gid)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if dir != volumePath {
+			return fmt.Errorf("gid %s is already in use by %s according to its volume metadata", gid, dir)
+		}
+	}
+
+	return nil
+}
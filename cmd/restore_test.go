@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+)
+
+// provisionRetainedVolume provisions a volume of a storage class with the given parameters and stores its PV in the
+// given phase, as if the directory was retained after its claim was deleted
+func provisionRetainedVolume(t *testing.T, p *efsProvisioner, parameters map[string]string, phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+	skipUnlessRoot(t)
+
+	ctx := context.Background()
+	options := newTestProvisionOptions(parameters)
+	if _, err := p.client.StorageV1().StorageClasses().Create(ctx, options.StorageClass, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatalf("failed to provision: %v", err)
+	}
+	// the controller sets the storage class of the PV
+	pv.Spec.StorageClassName = options.StorageClass.Name
+	pv.Status.Phase = phase
+	if _, err := p.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return pv
+}
+
+// testRetainedParameters are the parameters of the storage class of retained volumes
+var testRetainedParameters = map[string]string{"gidMin": "2000", "gidMax": "2100"}
+
+// newTestRestoreOptions builds the options of restoring the directory of the volume provisioned for the test claim
+func newTestRestoreOptions() restoreOptions {
+	return restoreOptions{
+		dir:            "data-pvc-1",
+		claimNamespace: "default",
+		claimName:      "data",
+		capacity:       resource.MustParse("1Mi"),
+		accessModes:    string(v1.ReadWriteMany),
+		reclaimPolicy:  string(v1.PersistentVolumeReclaimRetain),
+	}
+}
+
+func TestRestoreRetainedVolume(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	retained := provisionRetainedVolume(t, p, testRetainedParameters, v1.VolumeReleased)
+
+	ctx := context.Background()
+	if err := p.restoreVolume(ctx, p.fileSystems[0], newTestRestoreOptions()); err != nil {
+		t.Fatalf("expected the retained directory to be restored, got %v", err)
+	}
+
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, "restored-data-pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the restored PV to be created: %v", err)
+	}
+	if gid, expected := pv.Annotations[gidallocator.VolumeGidAnnotationKey], retained.Annotations[gidallocator.VolumeGidAnnotationKey]; gid != expected {
+		t.Errorf("expected the restored PV to keep gid %s, got '%s'", expected, gid)
+	}
+	if pv.Spec.NFS == nil || pv.Spec.NFS.Path != retained.Spec.NFS.Path {
+		t.Errorf("expected the restored PV to use the retained directory, got %v", pv.Spec.PersistentVolumeSource)
+	}
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name != "data" {
+		t.Errorf("expected the restored PV to be pre-bound to default/data, got %v", pv.Spec.ClaimRef)
+	}
+}
+
+func TestRestoreArchivedVolume(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	retained := provisionRetainedVolume(t, p, map[string]string{"gidMin": "2000", "gidMax": "2100", "onDelete": onDeleteArchive}, v1.VolumeReleased)
+
+	ctx := context.Background()
+	if err := p.Delete(ctx, retained); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := p.client.CoreV1().PersistentVolumes().Delete(ctx, retained.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the gid of the archived volume stays allocated until the archive is purged
+	gid, _ := strconv.Atoi(retained.Annotations[gidallocator.VolumeGidAnnotationKey])
+	if err := p.fileSystems[0].allocator.Reserve(ctx, "efs", gid, nil); !errors.Is(err, internal.ErrGIDAllocated) {
+		t.Fatalf("expected gid %d of the archived volume to stay allocated, got %v", gid, err)
+	}
+
+	archived, err := filepath.Glob(path.Join(p.fileSystems[0].mountpoint, internal.ArchiveDir, "data-pvc-1-*"))
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("expected the directory to be archived, got %v, %v", archived, err)
+	}
+
+	options := newTestRestoreOptions()
+	options.dir = path.Join(internal.ArchiveDir, path.Base(archived[0]))
+	if err := p.restoreVolume(ctx, p.fileSystems[0], options); err != nil {
+		t.Fatalf("expected the archived directory to be restored, got %v", err)
+	}
+
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, "restored-data-pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the restored PV to be created: %v", err)
+	}
+	if pv.Annotations[gidallocator.VolumeGidAnnotationKey] != retained.Annotations[gidallocator.VolumeGidAnnotationKey] {
+		t.Errorf("expected the restored PV to keep gid %d, got '%s'", gid, pv.Annotations[gidallocator.VolumeGidAnnotationKey])
+	}
+}
+
+func TestRestoreVolumeStillBound(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	provisionRetainedVolume(t, p, testRetainedParameters, v1.VolumeBound)
+
+	err := p.restoreVolume(context.Background(), p.fileSystems[0], newTestRestoreOptions())
+	if err == nil || !strings.Contains(err.Error(), "still the directory of PV pvc-1") {
+		t.Fatalf("expected restoring the directory of a bound PV to be refused, got %v", err)
+	}
+}
+
+func TestRestoreVolumeGIDInUse(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	retained := provisionRetainedVolume(t, p, testRetainedParameters, v1.VolumeReleased)
+
+	// another volume on the file system was allocated the same gid
+	other := retained.DeepCopy()
+	other.Name = "pvc-2"
+	other.Spec.NFS.Path = path.Join(path.Dir(other.Spec.NFS.Path), "other-pvc-2")
+	if _, err := p.client.CoreV1().PersistentVolumes().Create(context.Background(), other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := p.restoreVolume(context.Background(), p.fileSystems[0], newTestRestoreOptions())
+	if err == nil || !strings.Contains(err.Error(), "already in use by PV pvc-2") {
+		t.Fatalf("expected restoring a directory whose gid is in use to be refused, got %v", err)
+	}
+}
+
+func TestRestoreAccessPointVolume(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	provisionRetainedVolume(t, p, map[string]string{
+		"provisioningMode": provisioningModeAccessPoint,
+		"volumeType":       volumeTypeCSI,
+	}, v1.VolumeReleased)
+
+	options := newTestRestoreOptions()
+	options.volumeType = volumeTypeCSI
+	err := p.restoreVolume(context.Background(), p.fileSystems[0], options)
+	if err == nil || !strings.Contains(err.Error(), "can't create access points") {
+		t.Fatalf("expected restoring a volume of a storage class with access points to be refused, got %v", err)
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Get(context.Background(), "restored-data-pvc-1", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected no PV to be created")
+	}
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	enableSnapshotsKey = "ENABLE_SNAPSHOTS"
+
+	snapshotGroup    = "efs.onecause.com"
+	snapshotKind     = "EFSVolumeSnapshot"
+	snapshotResource = "efsvolumesnapshots"
+	snapshotVersion  = "v1alpha1"
+
+	// snapshotFinalizer keeps a snapshot resource around until its directory has been deleted
+	snapshotFinalizer = "efs.onecause.com/snapshot-protection"
+
+	snapshotResyncPeriod = 10 * time.Minute
+)
+
+var snapshotGVR = schema.GroupVersionResource{Group: snapshotGroup, Version: snapshotVersion, Resource: snapshotResource}
+
+// snapshotController takes and deletes the directory snapshots requested by EFSVolumeSnapshot resources.  A snapshot
+// is a copy of the directory of a claim's volume in the snapshot directory of the same file system.
+type snapshotController struct {
+	p        *efsProvisioner
+	client   dynamic.Interface
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// snapshotsEnabled determines if the EFSVolumeSnapshot custom resource definition is installed and the provisioner
+// should handle snapshots
+func snapshotsEnabled() bool {
+	enabledStr := os.Getenv(enableSnapshotsKey)
+	if enabledStr == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(enabledStr)
+	if err != nil {
+		klog.Fatalf("invalid value '%s' for environment variable %s: %v", enabledStr, enableSnapshotsKey, err)
+	}
+
+	return enabled
+}
+
+func newSnapshotController(p *efsProvisioner, client dynamic.Interface) *snapshotController {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, snapshotResyncPeriod)
+	informer := factory.ForResource(snapshotGVR).Informer()
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "snapshots")
+
+	enqueue := func(obj interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			queue.Add(key)
+		}
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	})
+
+	return &snapshotController{
+		p:        p,
+		client:   client,
+		factory:  factory,
+		informer: informer,
+		queue:    queue,
+	}
+}
+
+// run processes snapshots until the context is done
+func (c *snapshotController) run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		klog.Errorf("failed to sync the %s informer", snapshotResource)
+		return
+	}
+
+	klog.Info("Started snapshot controller")
+
+	// snapshots are copied one at a time so they don't compete with each other and with clones for the file system
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+
+	<-ctx.Done()
+}
+
+func (c *snapshotController) runWorker(ctx context.Context) {
+	for c.processNextSnapshot(ctx) {
+	}
+}
+
+func (c *snapshotController) processNextSnapshot(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.syncSnapshot(ctx, key.(string)); err != nil {
+		klog.Errorf("failed to sync snapshot %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *snapshotController) syncSnapshot(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	snapshot := obj.(*unstructured.Unstructured).DeepCopy()
+
+	if snapshot.GetDeletionTimestamp() != nil {
+		return c.deleteSnapshot(ctx, snapshot)
+	}
+
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+		return nil
+	}
+
+	if !hasFinalizer(snapshot, snapshotFinalizer) {
+		snapshot.SetFinalizers(append(snapshot.GetFinalizers(), snapshotFinalizer))
+		_, err := c.client.Resource(snapshotGVR).Namespace(snapshot.GetNamespace()).Update(ctx, snapshot, metav1.UpdateOptions{})
+		return err
+	}
+
+	if err := c.createSnapshot(ctx, snapshot); err != nil {
+		// the status is only updated when the error changes, since every update queues the snapshot again
+		if previous, _, _ := unstructured.NestedString(snapshot.Object, "status", "error"); previous == err.Error() {
+			return err
+		}
+		unstructured.SetNestedField(snapshot.Object, err.Error(), "status", "error")
+		if _, updateErr := c.client.Resource(snapshotGVR).Namespace(snapshot.GetNamespace()).UpdateStatus(ctx, snapshot, metav1.UpdateOptions{}); updateErr != nil {
+			klog.Errorf("failed to update status of snapshot %s: %v", key, updateErr)
+		}
+		return err
+	}
+
+	_, err = c.client.Resource(snapshotGVR).Namespace(snapshot.GetNamespace()).UpdateStatus(ctx, snapshot, metav1.UpdateOptions{})
+	return err
+}
+
+// createSnapshot copies the directory of the snapshot's claim into the snapshot directory and fills in the status of
+// the snapshot
+func (c *snapshotController) createSnapshot(ctx context.Context, snapshot *unstructured.Unstructured) error {
+	claimName, _, _ := unstructured.NestedString(snapshot.Object, "spec", "persistentVolumeClaimName")
+	if claimName == "" {
+		return fmt.Errorf("spec.persistentVolumeClaimName is required")
+	}
+
+	fs, volumePath, volume, err := c.p.getClaimLocalPath(ctx, snapshot.GetNamespace(), claimName)
+	if err != nil {
+		return err
+	}
+
+	dir := snapshotDirectory(snapshot)
+
+	if err := internal.CreateSnapshot(volumePath, path.Join(fs.mountpoint, dir), snapshot.GetNamespace()+"/"+snapshot.GetName()); err != nil {
+		return err
+	}
+
+	status := map[string]interface{}{
+		"readyToUse":         true,
+		"creationTime":       time.Now().UTC().Format(time.RFC3339),
+		"fileSystemId":       fs.id,
+		"snapshotDirectory":  dir,
+		"sourceVolumeName":   volume.Name,
+		"sourceStorageClass": volume.Spec.StorageClassName,
+	}
+
+	return unstructured.SetNestedMap(snapshot.Object, status, "status")
+}
+
+// deleteSnapshot deletes the directory of a snapshot that is being deleted and releases its finalizer
+func (c *snapshotController) deleteSnapshot(ctx context.Context, snapshot *unstructured.Unstructured) error {
+	if !hasFinalizer(snapshot, snapshotFinalizer) {
+		return nil
+	}
+
+	fs, snapshotPath, err := c.getSnapshotLocalPath(snapshot)
+	if err != nil {
+		klog.Warningf("not deleting the directory of snapshot %s/%s: %v", snapshot.GetNamespace(), snapshot.GetName(), err)
+	} else if fs != nil {
+		if err := internal.DeleteSnapshot(snapshotPath); err != nil {
+			return err
+		}
+		klog.Infof("deleted snapshot %s", snapshotPath)
+	}
+
+	var finalizers []string
+	for _, finalizer := range snapshot.GetFinalizers() {
+		if finalizer != snapshotFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	snapshot.SetFinalizers(finalizers)
+
+	_, err = c.client.Resource(snapshotGVR).Namespace(snapshot.GetNamespace()).Update(ctx, snapshot, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// snapshotDirectory returns the directory of a snapshot relative to the mountpoint of its file system.  The uid keeps a
+// snapshot that is recreated under the same name from reusing the directory of the old one.
+func snapshotDirectory(snapshot *unstructured.Unstructured) string {
+	return path.Join(internal.SnapshotDir, fmt.Sprintf("%s-%s-%s", snapshot.GetNamespace(), snapshot.GetName(), snapshot.GetUID()))
+}
+
+// getSnapshotLocalPath returns the file system and local path of the directory of a snapshot, or a nil file system if
+// no directory was created for it yet.  The status can be written by anyone allowed to update it, so the directory it
+// records must be the one that belongs to the snapshot, rather than that of a snapshot in another namespace.
+func (c *snapshotController) getSnapshotLocalPath(snapshot *unstructured.Unstructured) (*fileSystem, string, error) {
+	dir, _, _ := unstructured.NestedString(snapshot.Object, "status", "snapshotDirectory")
+	if dir == "" {
+		return nil, "", nil
+	}
+
+	if expected := snapshotDirectory(snapshot); dir != expected {
+		return nil, "", fmt.Errorf("snapshot directory %s in the status is not the directory %s of the snapshot", dir, expected)
+	}
+
+	fileSystemID, _, _ := unstructured.NestedString(snapshot.Object, "status", "fileSystemId")
+	for _, fs := range c.p.fileSystems {
+		if fs.id == fileSystemID {
+			return fs, path.Join(fs.mountpoint, dir), nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("file system %s is not configured in this provisioner", fileSystemID)
+}
+
+// getSnapshotPath returns the local path of the directory of the snapshot with the given name, which must be ready
+func (p *efsProvisioner) getSnapshotPath(namespace, name string) (string, error) {
+	if p.snapshots == nil {
+		return "", fmt.Errorf("snapshots are not enabled, set %s to enable them", enableSnapshotsKey)
+	}
+
+	obj, exists, err := p.snapshots.informer.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("snapshot %s/%s not found", namespace, name)
+	}
+	snapshot := obj.(*unstructured.Unstructured)
+
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready || snapshot.GetDeletionTimestamp() != nil {
+		return "", fmt.Errorf("snapshot %s/%s is not ready to use", namespace, name)
+	}
+
+	fs, snapshotPath, err := p.snapshots.getSnapshotLocalPath(snapshot)
+	if err != nil {
+		return "", err
+	}
+	if fs == nil {
+		return "", fmt.Errorf("snapshot %s/%s has no directory", namespace, name)
+	}
+
+	return snapshotPath, nil
+}
+
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSnapshotDataSource determines if the data source refers to an EFSVolumeSnapshot
+func isSnapshotDataSource(apiGroup *string, kind string) bool {
+	return apiGroup != nil && *apiGroup == snapshotGroup && kind == snapshotKind
+}
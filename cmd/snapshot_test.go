@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"path"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newTestSnapshot builds a snapshot whose status records the given directory
+func newTestSnapshot(namespace, name, uid, dir string) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{
+			"fileSystemId":      testFileSystemID,
+			"snapshotDirectory": dir,
+		},
+	}}
+	snapshot.SetNamespace(namespace)
+	snapshot.SetName(name)
+	snapshot.SetUID(types.UID(uid))
+	return snapshot
+}
+
+func TestGetSnapshotLocalPath(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	c := &snapshotController{p: p}
+	mountpoint := p.fileSystems[0].mountpoint
+
+	snapshot := newTestSnapshot("default", "backup", "1", path.Join(internal.SnapshotDir, "default-backup-1"))
+	fs, snapshotPath, err := c.getSnapshotLocalPath(snapshot)
+	if err != nil || fs == nil || snapshotPath != path.Join(mountpoint, internal.SnapshotDir, "default-backup-1") {
+		t.Errorf("expected the directory of the snapshot, got %v, '%s', %v", fs, snapshotPath, err)
+	}
+
+	for _, dir := range []string{
+		// the directory of a snapshot in another namespace
+		path.Join(internal.SnapshotDir, "other-backup-2"),
+		path.Join(internal.SnapshotDir, "default-backup-1", "..", "other-backup-2"),
+		"data-pvc-1",
+	} {
+		snapshot := newTestSnapshot("default", "backup", "1", dir)
+		if fs, _, err := c.getSnapshotLocalPath(snapshot); err == nil || fs != nil {
+			t.Errorf("expected snapshot directory '%s' to be refused", dir)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/OneCause/efs-provisioner/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+const (
+	usageScanIntervalKey = "USAGE_SCAN_INTERVAL"
+	usageScanRateKey     = "USAGE_SCAN_RATE"
+
+	// defaultUsageScanRate is the default number of files and directories stat'ed per second
+	defaultUsageScanRate = 500
+
+	usedBytesAnnotationKey      = "efs.onecause.com/used-bytes"
+	usedInodesAnnotationKey     = "efs.onecause.com/used-inodes"
+	usageScannedAtAnnotationKey = "efs.onecause.com/usage-scanned-at"
+)
+
+var (
+	usageLabels = []string{"namespace", "persistentvolumeclaim", "storageclass"}
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "efs_provisioner_volume_used_bytes",
+		Help: "The size of the files in the directory of a volume.",
+	}, usageLabels)
+
+	volumeUsedInodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "efs_provisioner_volume_used_inodes",
+		Help: "The number of files, directories and symlinks in the directory of a volume.",
+	}, usageLabels)
+
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "efs_provisioner_volume_capacity_bytes",
+		Help: "The capacity of a volume.",
+	}, usageLabels)
+)
+
+func init() {
+	prometheus.MustRegister(volumeUsedBytes, volumeUsedInodes, volumeCapacityBytes)
+}
+
+// usageScanner periodically walks the directory of every bound volume provisioned by this provisioner, publishes its
+// usage as annotations of the PV and as metrics, and checks it against the capacity of the volume
+type usageScanner struct {
+	p               *efsProvisioner
+	provisionerName string
+	interval        time.Duration
+	limiter         *rate.Limiter
+
+	// reported are the label values of the metrics published by the last scan
+	reported map[[3]string]bool
+	// exceeded are the volumes that exceeded their capacity in the last scan, whose claims were already told so
+	exceeded map[types.UID]bool
+}
+
+// runUsageScanner scans the usage of volumes every USAGE_SCAN_INTERVAL until the context is done.  Usage isn't scanned
+// if USAGE_SCAN_INTERVAL isn't set.
+func (p *efsProvisioner) runUsageScanner(ctx context.Context, provisionerName string) {
+	intervalStr := os.Getenv(usageScanIntervalKey)
+	if intervalStr == "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		klog.Fatalf("invalid value '%s' for environment variable %s: %v", intervalStr, usageScanIntervalKey, err)
+	}
+
+	scanRate := defaultUsageScanRate
+	if scanRateStr := os.Getenv(usageScanRateKey); scanRateStr != "" {
+		if scanRate, err = strconv.Atoi(scanRateStr); err != nil || scanRate <= 0 {
+			klog.Fatalf("invalid value '%s' for environment variable %s: must be a positive integer", scanRateStr, usageScanRateKey)
+		}
+	}
+
+	s := &usageScanner{
+		p:               p,
+		provisionerName: provisionerName,
+		interval:        interval,
+		limiter:         rate.NewLimiter(rate.Limit(scanRate), scanRate),
+		reported:        map[[3]string]bool{},
+		exceeded:        map[types.UID]bool{},
+	}
+
+	go s.run(ctx)
+}
+
+func (s *usageScanner) run(ctx context.Context) {
+	// the interval is counted from the end of a scan, since a scan of a large file system can take longer than it
+	for {
+		s.scan(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *usageScanner) scan(ctx context.Context) {
+	pvs, err := s.p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("failed to list PVs: %v", err)
+		return
+	}
+
+	// storage classes are looked up once per scan
+	quotaActions := map[string]string{}
+	reported := map[[3]string]bool{}
+	exceeded := map[types.UID]bool{}
+
+	for i := range pvs.Items {
+		volume := &pvs.Items[i]
+		if volume.Annotations[provisionedByAnnotationKey] != s.provisionerName || volume.Status.Phase != v1.VolumeBound || volume.Spec.ClaimRef == nil {
+			continue
+		}
+
+		className := util.GetPersistentVolumeClass(volume)
+		quotaAction, ok := quotaActions[className]
+		if !ok {
+			quotaAction = s.p.quotaActionForClass(ctx, className)
+			quotaActions[className] = quotaAction
+		}
+
+		// the metrics of a volume that can't be scanned keep their last values
+		reported[[3]string{volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name, className}] = true
+
+		volumeExceeded, err := s.scanVolume(ctx, volume, quotaAction, s.exceeded[volume.UID])
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			klog.Errorf("failed to scan usage of volume %s: %v", volume.Name, err)
+		}
+		if volumeExceeded {
+			exceeded[volume.UID] = true
+		}
+	}
+
+	// metrics of volumes that are gone
+	for labels := range s.reported {
+		if !reported[labels] {
+			for _, gauge := range []*prometheus.GaugeVec{volumeUsedBytes, volumeUsedInodes, volumeCapacityBytes, quotaExceeded} {
+				gauge.DeleteLabelValues(labels[:]...)
+			}
+		}
+	}
+	s.reported = reported
+	s.exceeded = exceeded
+}
+
+// scanVolume scans the usage of the given volume and checks its quota.  Whether the volume exceeds its capacity is
+// returned, or wasExceeded if that couldn't be determined.
+func (s *usageScanner) scanVolume(ctx context.Context, volume *v1.PersistentVolume, quotaAction string, wasExceeded bool) (bool, error) {
+	fs, remotePath, err := s.p.getVolumeFileSystem(ctx, volume)
+	if err != nil {
+		return wasExceeded, err
+	}
+
+	volumePath, err := fs.getLocalPathForRemotePath(remotePath)
+	if err != nil {
+		return wasExceeded, err
+	}
+
+	usage, err := internal.DirectoryUsage(ctx, volumePath, s.limiter)
+	if err != nil {
+		return wasExceeded, err
+	}
+
+	claim := volume.Spec.ClaimRef
+	className := util.GetPersistentVolumeClass(volume)
+
+	volumeUsedBytes.WithLabelValues(claim.Namespace, claim.Name, className).Set(float64(usage.Bytes))
+	volumeUsedInodes.WithLabelValues(claim.Namespace, claim.Name, className).Set(float64(usage.Inodes))
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+		volumeCapacityBytes.WithLabelValues(claim.Namespace, claim.Name, className).Set(float64(capacity.Value()))
+	}
+
+	usedBytes := strconv.FormatInt(usage.Bytes, 10)
+	usedInodes := strconv.FormatInt(usage.Inodes, 10)
+	scannedAt := time.Now().UTC().Format(time.RFC3339)
+	if err := s.p.patchVolumeAnnotations(ctx, volume.Name, map[string]*string{
+		usedBytesAnnotationKey:      &usedBytes,
+		usedInodesAnnotationKey:     &usedInodes,
+		usageScannedAtAnnotationKey: &scannedAt,
+	}); err != nil {
+		return wasExceeded, err
+	}
+
+	return s.p.checkQuota(ctx, volume, volumePath, usage, quotaAction, wasExceeded)
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// accessPointPermissions are the permissions EFS gives the root directory of an access point if it has to create it
+	accessPointPermissions = "0771"
+)
+
+// ErrAccessPointNotFound is returned when an access point doesn't exist, e.g. because it was already deleted
+var ErrAccessPointNotFound = errors.New("access point not found")
+
+// AccessPointOptions describes the access point that should be created for a single volume.
+type AccessPointOptions struct {
+	FileSystemID string
+	// ClientToken makes creation idempotent so that a retried Provision call doesn't leak access points
+	ClientToken  string
+	RootDir      string
+	UID          int64
+	GID          int64
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+}
+
+// CreateAccessPoint creates an EFS access point that enforces the POSIX identity of the volume and is rooted at
+// the volume's directory, returning the id of the new access point.
+func CreateAccessPoint(ctx context.Context, svc efsiface.EFSAPI, opts AccessPointOptions) (string, error) {
+	input := &efs.CreateAccessPointInput{
+		ClientToken:  aws.String(opts.ClientToken),
+		FileSystemId: aws.String(opts.FileSystemID),
+		PosixUser: &efs.PosixUser{
+			Uid: aws.Int64(opts.UID),
+			Gid: aws.Int64(opts.GID),
+		},
+		RootDirectory: &efs.RootDirectory{
+			Path: aws.String(opts.RootDir),
+			CreationInfo: &efs.CreationInfo{
+				OwnerUid:    aws.Int64(opts.UID),
+				OwnerGid:    aws.Int64(opts.GID),
+				Permissions: aws.String(accessPointPermissions),
+			},
+		},
+		Tags: []*efs.Tag{
+			{Key: aws.String("Name"), Value: aws.String(opts.PVName)},
+			{Key: aws.String("kubernetes.io/created-for/pvc/name"), Value: aws.String(opts.PVCName)},
+			{Key: aws.String("kubernetes.io/created-for/pvc/namespace"), Value: aws.String(opts.PVCNamespace)},
+			{Key: aws.String("kubernetes.io/created-for/pv/gid"), Value: aws.String(strconv.FormatInt(opts.GID, 10))},
+		},
+	}
+
+	out, err := svc.CreateAccessPointWithContext(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to create access point on %s for %s: %v", opts.FileSystemID, opts.RootDir, err)
+	}
+
+	klog.Infof("created access point %s on %s rooted at %s", aws.StringValue(out.AccessPointId), opts.FileSystemID, opts.RootDir)
+
+	return aws.StringValue(out.AccessPointId), nil
+}
+
+// DeleteAccessPoint deletes the given EFS access point.  An access point that no longer exists is not treated as an error.
+func DeleteAccessPoint(ctx context.Context, svc efsiface.EFSAPI, accessPointID string) error {
+	_, err := svc.DeleteAccessPointWithContext(ctx, &efs.DeleteAccessPointInput{
+		AccessPointId: aws.String(accessPointID),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == efs.ErrCodeAccessPointNotFound {
+		klog.Warningf("access point %s was already deleted", accessPointID)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to delete access point %s: %v", accessPointID, err)
+	}
+
+	klog.Infof("deleted access point %s", accessPointID)
+
+	return nil
+}
+
+// DescribeAccessPointRootDir returns the path of the root directory of the given EFS access point.  An error wrapping
+// ErrAccessPointNotFound is returned if the access point doesn't exist.
+func DescribeAccessPointRootDir(ctx context.Context, svc efsiface.EFSAPI, accessPointID string) (string, error) {
+	out, err := svc.DescribeAccessPointsWithContext(ctx, &efs.DescribeAccessPointsInput{
+		AccessPointId: aws.String(accessPointID),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == efs.ErrCodeAccessPointNotFound {
+		return "", fmt.Errorf("failed to describe access point %s: %w", accessPointID, ErrAccessPointNotFound)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to describe access point %s: %v", accessPointID, err)
+	}
+
+	if len(out.AccessPoints) != 1 || out.AccessPoints[0].RootDirectory == nil {
+		return "", fmt.Errorf("access point %s has no root directory", accessPointID)
+	}
+
+	return aws.StringValue(out.AccessPoints[0].RootDirectory.Path), nil
+}
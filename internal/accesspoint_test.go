@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OneCause/efs-provisioner/internal/efstest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/efs"
+)
+
+func TestCreateAccessPoint(t *testing.T) {
+	svc := efstest.NewFakeEFS()
+
+	id, err := CreateAccessPoint(context.Background(), svc, AccessPointOptions{
+		FileSystemID: "fs-1",
+		ClientToken:  "pvc-1",
+		RootDir:      "/data-pvc-1",
+		UID:          1001,
+		GID:          2000,
+		PVName:       "pvc-1",
+		PVCName:      "data",
+		PVCNamespace: "default",
+	})
+	if err != nil {
+		t.Fatalf("CreateAccessPoint failed: %v", err)
+	}
+	if id != "fsap-pvc-1" {
+		t.Errorf("expected access point fsap-pvc-1, got %s", id)
+	}
+
+	input := svc.AccessPoints[id]
+	if aws.StringValue(input.FileSystemId) != "fs-1" {
+		t.Errorf("expected file system fs-1, got %s", aws.StringValue(input.FileSystemId))
+	}
+	if uid, gid := aws.Int64Value(input.PosixUser.Uid), aws.Int64Value(input.PosixUser.Gid); uid != 1001 || gid != 2000 {
+		t.Errorf("expected POSIX user 1001:2000, got %d:%d", uid, gid)
+	}
+	if path := aws.StringValue(input.RootDirectory.Path); path != "/data-pvc-1" {
+		t.Errorf("expected root directory /data-pvc-1, got %s", path)
+	}
+	if owner := aws.Int64Value(input.RootDirectory.CreationInfo.OwnerGid); owner != 2000 {
+		t.Errorf("expected the root directory to be created for gid 2000, got %d", owner)
+	}
+
+	root, err := DescribeAccessPointRootDir(context.Background(), svc, id)
+	if err != nil {
+		t.Fatalf("DescribeAccessPointRootDir failed: %v", err)
+	}
+	if root != "/data-pvc-1" {
+		t.Errorf("expected root directory /data-pvc-1, got %s", root)
+	}
+}
+
+func TestDeleteAccessPoint(t *testing.T) {
+	svc := efstest.NewFakeEFS()
+	svc.AccessPoints["fsap-1"] = &efs.CreateAccessPointInput{}
+
+	if err := DeleteAccessPoint(context.Background(), svc, "fsap-1"); err != nil {
+		t.Fatalf("DeleteAccessPoint failed: %v", err)
+	}
+	if _, ok := svc.AccessPoints["fsap-1"]; ok {
+		t.Errorf("access point fsap-1 was not deleted")
+	}
+
+	// an access point that is already gone is deleted as far as the provisioner is concerned
+	if err := DeleteAccessPoint(context.Background(), svc, "fsap-1"); err != nil {
+		t.Errorf("expected deleting a missing access point to succeed, got %v", err)
+	}
+
+	svc.DeleteErr = awserr.New(efs.ErrCodeInternalServerError, "internal error", nil)
+	if err := DeleteAccessPoint(context.Background(), svc, "fsap-2"); err == nil {
+		t.Errorf("expected other errors to be returned")
+	}
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ArchiveDir is the directory under the base path into which deleted volumes are moved when they are archived
+	ArchiveDir = ".archive"
+
+	archiveTimestampFormat = "20060102T150405Z"
+)
+
+// ArchiveVolume moves the given volume directory into the archive directory next to it, suffixing its name with the
+// current time, and records when and from where it was archived in its volume metadata.  The new path is returned.
+func ArchiveVolume(volumePath string) (string, error) {
+	now := time.Now().UTC()
+
+	archivePath := path.Join(path.Dir(volumePath), ArchiveDir)
+	if err := os.MkdirAll(archivePath, 0700); err != nil {
+		return "", LogErrorf("failed to create archive directory %s: %v", archivePath, err)
+	}
+
+	archivedPath := path.Join(archivePath, path.Base(volumePath)+"-"+now.Format(archiveTimestampFormat))
+	if err := os.Rename(volumePath, archivedPath); err != nil {
+		return "", LogErrorf("failed to archive %s to %s: %v", volumePath, archivedPath, err)
+	}
+
+	// a retried delete only archives the directory if it is still where it was
+	if err := MoveVolumeMetadata(volumePath, archivedPath); err != nil {
+		if err := os.Rename(archivedPath, volumePath); err != nil {
+			klog.Errorf("failed to move %s back to %s: %v", archivedPath, volumePath, err)
+		}
+		return "", err
+	}
+
+	md, err := ReadVolumeMetadata(archivedPath)
+	if err != nil {
+		klog.Warningf("failed to read volume metadata of archived volume %s, it will be replaced: %v", archivedPath, err)
+	}
+	if md == nil {
+		md = &VolumeMetadata{}
+	}
+
+	md.ArchivedAt = &now
+	md.ArchivedFrom = path.Base(volumePath)
+
+	// without the time it was archived at, the sweeper would never purge the directory, so it's moved back
+	if err := WriteVolumeMetadata(archivedPath, *md); err != nil {
+		moveVolumeBack(archivedPath, volumePath)
+		return "", err
+	}
+
+	klog.Infof("archived %s to %s", volumePath, archivedPath)
+
+	return archivedPath, nil
+}
+
+// moveVolumeBack moves a directory that was just archived or restored from previousPath to currentPath back to where
+// it was along with its metadata
+func moveVolumeBack(currentPath, previousPath string) {
+	if err := MoveVolumeMetadata(currentPath, previousPath); err != nil {
+		klog.Errorf("failed to move the metadata of %s back to %s: %v", currentPath, previousPath, err)
+	}
+	if err := os.Rename(currentPath, previousPath); err != nil {
+		klog.Errorf("failed to move %s back to %s: %v", currentPath, previousPath, err)
+	}
+}
+
+// SweepArchives permanently deletes the volumes in the archive directory under the base path that were archived more
+// than ttl ago and releases their gids through the allocator, if it isn't nil.  Directories whose metadata doesn't say
+// when they were archived are left alone, since nothing else tells when they were.
+func SweepArchives(ctx context.Context, basePath string, ttl time.Duration, allocator *GIDAllocator) error {
+	archivePath := path.Join(basePath, ArchiveDir)
+
+	entries, err := ioutil.ReadDir(archivePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		klog.Errorf("failed to list contents of %s: %v", archivePath, err)
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == MetadataDir {
+			continue
+		}
+
+		archivedPath := path.Join(archivePath, entry.Name())
+
+		md, err := ReadVolumeMetadata(archivedPath)
+		if err != nil {
+			klog.Warningf("not purging %s since its volume metadata can't be read: %v", archivedPath, err)
+			continue
+		} else if md == nil || md.ArchivedAt == nil {
+			klog.Warningf("not purging %s since its volume metadata doesn't say when it was archived", archivedPath)
+			continue
+		}
+
+		archivedAt := *md.ArchivedAt
+		if time.Since(archivedAt) < ttl {
+			continue
+		}
+
+		klog.Infof("purging %s which was archived at %s", archivedPath, archivedAt.Format(time.RFC3339))
+
+		if err := os.RemoveAll(archivedPath); err != nil {
+			klog.Errorf("failed to purge %s: %v", archivedPath, err)
+			continue
+		}
+
+		DeleteVolumeMetadata(archivedPath)
+
+		// the gid stayed allocated so that the volume could be restored with it
+		if allocator == nil || md.GID == "" || md.StorageClassName == "" {
+			continue
+		}
+
+		gid, err := ParseGID(md.GID)
+		if err != nil {
+			klog.Errorf("invalid GID value '%s' in metadata for %s", md.GID, archivedPath)
+			continue
+		}
+
+		if err := allocator.ReleaseGID(ctx, md.StorageClassName, gid); err != nil {
+			klog.Errorf("failed to release gid %d of purged volume %s of storage class %s: %v", gid, archivedPath, md.StorageClassName, err)
+		}
+	}
+
+	return nil
+}
+
+// RunArchiveSweeper sweeps the archive directory under the base path every interval until the context is done
+func RunArchiveSweeper(ctx context.Context, basePath string, ttl, interval time.Duration, allocator *GIDAllocator) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		SweepArchives(ctx, basePath, ttl, allocator)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RestoreArchivedVolume moves an archived volume directory back to the directory it was archived from, which must not
+// exist, and clears the archive details from its volume metadata.  The restored path is returned.
+func RestoreArchivedVolume(archivedPath string, md *VolumeMetadata) (string, error) {
+	if md.ArchivedFrom == "" {
+		return "", LogErrorf("volume metadata of %s doesn't record where it was archived from", archivedPath)
+	}
+
+	restoredPath := path.Join(path.Dir(path.Dir(archivedPath)), md.ArchivedFrom)
+	if _, err := os.Stat(restoredPath); err == nil {
+		return "", LogErrorf("cannot restore %s since %s already exists", archivedPath, restoredPath)
+	} else if !os.IsNotExist(err) {
+		return "", LogErrorf("failed to determine if %s already exists: %v", restoredPath, err)
+	}
+
+	if err := os.Rename(archivedPath, restoredPath); err != nil {
+		return "", LogErrorf("failed to restore %s to %s: %v", archivedPath, restoredPath, err)
+	}
+
+	// the directory stays in the archive unless its metadata moves with it, otherwise the sweeper would never find its
+	// metadata and the directory would be live without any
+	if err := MoveVolumeMetadata(archivedPath, restoredPath); err != nil {
+		if err := os.Rename(restoredPath, archivedPath); err != nil {
+			klog.Errorf("failed to move %s back to %s: %v", restoredPath, archivedPath, err)
+		}
+		return "", err
+	}
+
+	archivedAt, archivedFrom := md.ArchivedAt, md.ArchivedFrom
+	md.ArchivedAt = nil
+	md.ArchivedFrom = ""
+
+	if err := WriteVolumeMetadata(restoredPath, *md); err != nil {
+		md.ArchivedAt, md.ArchivedFrom = archivedAt, archivedFrom
+		moveVolumeBack(restoredPath, archivedPath)
+		return "", err
+	}
+
+	klog.Infof("restored %s to %s", archivedPath, restoredPath)
+
+	return restoredPath, nil
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSweepArchives(t *testing.T) {
+	base := t.TempDir()
+	archivePath := path.Join(base, ArchiveDir)
+	longAgo := time.Now().Add(-48 * time.Hour)
+
+	for _, name := range []string{"expired", "recent", "no-metadata"} {
+		dir := path.Join(archivePath, name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		// a rename doesn't change the modification time, so it says nothing about when the directory was archived
+		if err := os.Chtimes(dir, longAgo, longAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recently := time.Now()
+	for name, archivedAt := range map[string]*time.Time{"expired": &longAgo, "recent": &recently} {
+		if err := WriteVolumeMetadata(path.Join(archivePath, name), VolumeMetadata{ArchivedAt: archivedAt, ArchivedFrom: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SweepArchives(context.Background(), base, 24*time.Hour, nil); err != nil {
+		t.Fatalf("SweepArchives failed: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(archivePath, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired directory to be purged, got %v", err)
+	}
+	for _, name := range []string{"recent", "no-metadata"} {
+		if _, err := os.Stat(path.Join(archivePath, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestSweepArchivesReleasesGID(t *testing.T) {
+	base := t.TempDir()
+	archivedPath := path.Join(base, ArchiveDir, "data-pvc-1-20240101T000000Z")
+	if err := os.MkdirAll(archivedPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	longAgo := time.Now().Add(-48 * time.Hour)
+	if err := WriteVolumeMetadata(archivedPath, VolumeMetadata{GID: "2000", StorageClassName: "efs", ArchivedAt: &longAgo, ArchivedFrom: "data-pvc-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewGIDAllocator(fake.NewSimpleClientset(), NewFileSystemReclaimer(base), nil, nil)
+	ctx := context.Background()
+
+	// the gid of the archived volume is collected from its metadata
+	if err := a.Reserve(ctx, "efs", 2000, nil); !errors.Is(err, ErrGIDAllocated) {
+		t.Fatalf("expected the gid of the archived volume to be allocated, got %v", err)
+	}
+
+	if err := SweepArchives(ctx, base, 24*time.Hour, a); err != nil {
+		t.Fatalf("SweepArchives failed: %v", err)
+	}
+
+	if err := a.Reserve(ctx, "efs", 2000, nil); err != nil {
+		t.Errorf("expected the gid of the purged volume to be released, got %v", err)
+	}
+}
+
+func TestRestoreArchivedVolumeRollback(t *testing.T) {
+	base := t.TempDir()
+	archivedPath := path.Join(base, ArchiveDir, "data-pvc-1-20240101T000000Z")
+	if err := os.MkdirAll(archivedPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	archivedAt := time.Now()
+	md := VolumeMetadata{ArchivedAt: &archivedAt, ArchivedFrom: "data-pvc-1"}
+	if err := WriteVolumeMetadata(archivedPath, md); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory in place of the metadata file of the restored directory keeps the metadata from being moved there
+	if err := os.MkdirAll(path.Join(getMetaDataPath(path.Join(base, "data-pvc-1")), "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RestoreArchivedVolume(archivedPath, &md); err == nil {
+		t.Fatalf("expected restoring to fail")
+	}
+
+	if _, err := os.Stat(archivedPath); err != nil {
+		t.Errorf("expected the directory to be moved back into the archive: %v", err)
+	}
+	if restored, err := ReadVolumeMetadata(archivedPath); err != nil || restored == nil || restored.ArchivedAt == nil {
+		t.Errorf("expected the archived directory to keep its metadata, got %v, %v", restored, err)
+	}
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// permBits are the mode bits that are copied, which includes the special bits os.FileMode.Perm leaves out
+	permBits = unix.S_ISUID | unix.S_ISGID | unix.S_ISVTX | 0777
+
+	// openFlags are used to open every source and destination of a copy.  The source may be writable by the tenant of
+	// the volume while it is copied, so nothing is opened through a symlink and a FIFO swapped in for a file doesn't
+	// block the copy.
+	openFlags = unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC | unix.O_NONBLOCK
+)
+
+// CopyTree recursively copies the contents of the src directory into the existing dst directory, preserving modes,
+// owners, symlinks and extended attributes where possible.  The dst directory itself is left as it is.  If uid or gid
+// is set, everything that is copied is owned by that user or group instead of the owner or group of the original.
+//
+// The source may be modified while it is copied, so it is walked relative to the file descriptors of its directories
+// and every entry is checked to still be the file it was listed as once it is opened.  Symlinks are copied as
+// symlinks and never followed.
+func CopyTree(src, dst string, uid, gid *int) error {
+	srcFd, err := unix.Open(src, openFlags|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: src, Err: err}
+	}
+	defer unix.Close(srcFd)
+
+	dstFd, err := unix.Open(dst, openFlags|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dst, Err: err}
+	}
+	defer unix.Close(dstFd)
+
+	return copyDirContents(srcFd, dstFd, src, dst, uid, gid)
+}
+
+// copyDirContents copies the entries of the directory open as srcFd into the directory open as dstFd.  srcPath and
+// dstPath are only used in messages.
+func copyDirContents(srcFd, dstFd int, srcPath, dstPath string, uid, gid *int) error {
+	// reading the names through a duplicate leaves srcFd open for the caller
+	dupFd, err := unix.Dup(srcFd)
+	if err != nil {
+		return &os.PathError{Op: "dup", Path: srcPath, Err: err}
+	}
+	dir := os.NewFile(uintptr(dupFd), srcPath)
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := copyEntry(srcFd, dstFd, name, filepath.Join(srcPath, name), filepath.Join(dstPath, name), uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyEntry copies the entry name of the directory open as srcFd into the directory open as dstFd
+func copyEntry(srcFd, dstFd int, name, srcPath, dstPath string, uid, gid *int) error {
+	var stat unix.Stat_t
+	if err := unix.Fstatat(srcFd, name, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lstat", Path: srcPath, Err: err}
+	}
+
+	owner, group := int(stat.Uid), int(stat.Gid)
+	if uid != nil {
+		owner = *uid
+	}
+	if gid != nil {
+		group = *gid
+	}
+
+	switch stat.Mode & unix.S_IFMT {
+	case unix.S_IFLNK:
+		target, err := readlinkat(srcFd, name)
+		if err != nil {
+			return &os.PathError{Op: "readlink", Path: srcPath, Err: err}
+		}
+		if err := unix.Symlinkat(target, dstFd, name); err != nil {
+			return &os.PathError{Op: "symlink", Path: dstPath, Err: err}
+		}
+		if err := unix.Fchownat(dstFd, name, owner, group, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fmt.Errorf("failed to chown %s: %v", dstPath, err)
+		}
+		return nil
+	case unix.S_IFDIR:
+		in, err := openEntry(srcFd, name, srcPath, unix.O_DIRECTORY, &stat)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(in)
+
+		if err := unix.Mkdirat(dstFd, name, 0700); err != nil {
+			return &os.PathError{Op: "mkdir", Path: dstPath, Err: err}
+		}
+		out, err := unix.Openat(dstFd, name, openFlags|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: dstPath, Err: err}
+		}
+		defer unix.Close(out)
+
+		if err := copyDirContents(in, out, srcPath, dstPath, uid, gid); err != nil {
+			return err
+		}
+		return setAttributes(in, out, dstPath, owner, group, stat.Mode)
+	case unix.S_IFREG:
+		in, err := openEntry(srcFd, name, srcPath, 0, &stat)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(in)
+
+		out, err := unix.Openat(dstFd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: dstPath, Err: err}
+		}
+		defer unix.Close(out)
+
+		if err := copyFile(in, out); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %v", srcPath, dstPath, err)
+		}
+		return setAttributes(in, out, dstPath, owner, group, stat.Mode)
+	default:
+		klog.Warningf("skipping %s since it is neither a regular file, directory nor symlink", srcPath)
+		return nil
+	}
+}
+
+// openEntry opens the entry name of the directory open as dirFd without following symlinks, and makes sure that it is
+// still the file stat describes, rather than something that replaced it after it was listed
+func openEntry(dirFd int, name, path string, flags int, stat *unix.Stat_t) (int, error) {
+	fd, err := unix.Openat(dirFd, name, openFlags|flags, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var opened unix.Stat_t
+	if err := unix.Fstat(fd, &opened); err != nil {
+		unix.Close(fd)
+		return -1, &os.PathError{Op: "fstat", Path: path, Err: err}
+	}
+	if opened.Dev != stat.Dev || opened.Ino != stat.Ino || opened.Mode&unix.S_IFMT != stat.Mode&unix.S_IFMT {
+		unix.Close(fd)
+		return -1, fmt.Errorf("%s was replaced while it was copied", path)
+	}
+
+	return fd, nil
+}
+
+// setAttributes gives the copy open as out the given owner, group and mode, and the extended attributes of in
+func setAttributes(in, out int, dstPath string, owner, group int, mode uint32) error {
+	// chown clears the setuid and setgid bits, so it has to come before the chmod
+	if err := unix.Fchown(out, owner, group); err != nil {
+		return fmt.Errorf("failed to chown %s: %v", dstPath, err)
+	}
+
+	if err := unix.Fchmod(out, mode&permBits); err != nil {
+		return fmt.Errorf("failed to chmod %s: %v", dstPath, err)
+	}
+
+	copyXattrs(in, out, dstPath)
+
+	return nil
+}
+
+func copyFile(in, out int) error {
+	buf := make([]byte, 128*1024)
+	for {
+		n, err := unix.Read(in, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		for written := 0; written < n; {
+			m, err := unix.Write(out, buf[written:n])
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			written += m
+		}
+	}
+}
+
+// copyXattrs copies the extended attributes of the file open as in to the file open as out.  Many file systems, EFS
+// among them, support few or no extended attributes, so failures are only logged.
+func copyXattrs(in, out int, dstPath string) {
+	size, err := unix.Flistxattr(in, nil)
+	if err != nil || size == 0 {
+		return
+	}
+
+	names := make([]byte, size)
+	if size, err = unix.Flistxattr(in, names); err != nil {
+		klog.V(4).Infof("failed to list extended attributes to copy to %s: %v", dstPath, err)
+		return
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		valueSize, err := unix.Fgetxattr(in, string(name), nil)
+		if err != nil {
+			klog.V(4).Infof("failed to get extended attribute %s to copy to %s: %v", name, dstPath, err)
+			continue
+		}
+
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Fgetxattr(in, string(name), value); err != nil {
+			klog.V(4).Infof("failed to get extended attribute %s to copy to %s: %v", name, dstPath, err)
+			continue
+		}
+
+		if err := unix.Fsetxattr(out, string(name), value[:valueSize], 0); err != nil {
+			klog.V(4).Infof("failed to set extended attribute %s on %s: %v", name, dstPath, err)
+		}
+	}
+}
+
+// readlinkat returns the target of the symlink name in the directory open as dirFd
+func readlinkat(dirFd int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirFd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// EmptyDirectory removes the contents of the given directory
+func EmptyDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyTreeSymlinks(t *testing.T) {
+	base := t.TempDir()
+	src, dst, secret := path.Join(base, "src"), path.Join(base, "dst"), path.Join(base, "secret")
+	for _, dir := range []string{src, dst, secret} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(secret, "data"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, path.Join(src, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(secret, "data"), path.Join(src, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyTree(src, dst, nil, nil); err != nil {
+		t.Fatalf("CopyTree failed: %v", err)
+	}
+
+	for _, name := range []string{"dir", "file"} {
+		info, err := os.Lstat(path.Join(dst, name))
+		if err != nil {
+			t.Fatalf("expected %s to be copied: %v", name, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %s to be copied as a symlink, got mode %v", name, info.Mode())
+		}
+	}
+}
+
+func TestOpenEntryReplaced(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"data", "other"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirFd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirFd)
+
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirFd, "data", &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry is replaced between listing and opening it
+	if err := os.Rename(path.Join(dir, "other"), path.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fd, err := openEntry(dirFd, "data", path.Join(dir, "data"), 0, &stat); err == nil {
+		unix.Close(fd)
+		t.Errorf("expected opening a replaced entry to fail")
+	}
+
+	// a symlink swapped in for the entry isn't followed
+	if err := os.Remove(path.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, path.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if fd, err := openEntry(dirFd, "data", path.Join(dir, "data"), unix.O_DIRECTORY, &stat); err == nil {
+		unix.Close(fd)
+		t.Errorf("expected opening a symlink to fail")
+	}
+}
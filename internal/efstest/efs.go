@@ -0,0 +1,55 @@
+// Package efstest provides a fake of the EFS API for tests
+package efstest
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+)
+
+// FakeEFS implements the access point calls of the EFS API on top of an in-memory map
+type FakeEFS struct {
+	efsiface.EFSAPI
+
+	// AccessPoints are the inputs the access points were created with by their ids
+	AccessPoints map[string]*efs.CreateAccessPointInput
+	// DeleteErr is returned by every DeleteAccessPoint call if set
+	DeleteErr error
+}
+
+func NewFakeEFS() *FakeEFS {
+	return &FakeEFS{AccessPoints: map[string]*efs.CreateAccessPointInput{}}
+}
+
+func (f *FakeEFS) CreateAccessPointWithContext(_ aws.Context, input *efs.CreateAccessPointInput, _ ...request.Option) (*efs.CreateAccessPointOutput, error) {
+	id := "fsap-" + aws.StringValue(input.ClientToken)
+	f.AccessPoints[id] = input
+	return &efs.CreateAccessPointOutput{AccessPointId: aws.String(id)}, nil
+}
+
+func (f *FakeEFS) DeleteAccessPointWithContext(_ aws.Context, input *efs.DeleteAccessPointInput, _ ...request.Option) (*efs.DeleteAccessPointOutput, error) {
+	if f.DeleteErr != nil {
+		return nil, f.DeleteErr
+	}
+
+	id := aws.StringValue(input.AccessPointId)
+	if _, ok := f.AccessPoints[id]; !ok {
+		return nil, awserr.New(efs.ErrCodeAccessPointNotFound, "access point not found", nil)
+	}
+	delete(f.AccessPoints, id)
+	return &efs.DeleteAccessPointOutput{}, nil
+}
+
+func (f *FakeEFS) DescribeAccessPointsWithContext(_ aws.Context, input *efs.DescribeAccessPointsInput, _ ...request.Option) (*efs.DescribeAccessPointsOutput, error) {
+	id := aws.StringValue(input.AccessPointId)
+	ap, ok := f.AccessPoints[id]
+	if !ok {
+		return nil, awserr.New(efs.ErrCodeAccessPointNotFound, "access point not found", nil)
+	}
+	return &efs.DescribeAccessPointsOutput{AccessPoints: []*efs.AccessPointDescription{{
+		AccessPointId: aws.String(id),
+		RootDirectory: ap.RootDirectory,
+	}}}, nil
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/mount"
+)
+
+const (
+	// efsUtilsStateDir is where efs-utils keeps a state file for every mount it makes through its stunnel TLS proxy
+	efsUtilsStateDir = "/var/run/efs"
+
+	stunnelHost = "127.0.0.1"
+)
+
+// IsStunnelMount determines if the mount entry is an EFS mount made by efs-utils with TLS, in which case the NFS client
+// connects to the local stunnel proxy rather than to the file system itself.
+func IsStunnelMount(e *mount.Info) bool {
+	if e.Fstype != "nfs4" && e.Fstype != "efs" {
+		return false
+	}
+
+	return strings.HasPrefix(e.Source, stunnelHost+":")
+}
+
+// FindStunnelMount looks for the efs-utils TLS mount of the given file system.  efs-utils names its state files
+// [file system id].[mountpoint].[stunnel port], so the mount can be identified by the port the NFS client connects to.
+// If efs-utils state isn't available and onlyFileSystem is set because no other file system is configured, a single TLS
+// mount is assumed to belong to the file system.
+func FindStunnelMount(fileSystemID string, entries []*mount.Info, onlyFileSystem bool) *mount.Info {
+	var stunnelMounts []*mount.Info
+	for _, e := range entries {
+		if IsStunnelMount(e) {
+			stunnelMounts = append(stunnelMounts, e)
+		}
+	}
+
+	if len(stunnelMounts) == 0 {
+		return nil
+	}
+
+	ports, err := getStunnelPorts(fileSystemID)
+	if err != nil {
+		klog.Warningf("failed to read efs-utils state from %s: %v", efsUtilsStateDir, err)
+	}
+
+	for _, e := range stunnelMounts {
+		for _, port := range ports {
+			if hasMountOption(e, "port="+port) {
+				return e
+			}
+		}
+	}
+
+	if onlyFileSystem && len(ports) == 0 && len(stunnelMounts) == 1 {
+		klog.Warningf("assuming the only TLS mount %s at %s belongs to %s", stunnelMounts[0].Source, stunnelMounts[0].Mountpoint, fileSystemID)
+		return stunnelMounts[0]
+	}
+
+	return nil
+}
+
+// getStunnelPorts returns the stunnel ports efs-utils uses for the mounts of the given file system
+func getStunnelPorts(fileSystemID string) ([]string, error) {
+	entries, err := ioutil.ReadDir(efsUtilsStateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ports []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, fileSystemID+".") {
+			continue
+		}
+
+		ports = append(ports, name[strings.LastIndex(name, ".")+1:])
+	}
+
+	return ports, nil
+}
+
+// hasMountOption checks both the per mount and the super block options of the mount entry for the given option
+func hasMountOption(e *mount.Info, option string) bool {
+	for _, opts := range []string{e.Opts, e.VfsOpts} {
+		for _, opt := range strings.Split(opts, ",") {
+			if opt == option {
+				return true
+			}
+		}
+	}
+
+	return false
+}
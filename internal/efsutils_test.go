@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/mount"
+)
+
+func TestFindStunnelMountWithoutState(t *testing.T) {
+	if _, err := os.Stat(efsUtilsStateDir); err == nil {
+		t.Skipf("efs-utils state exists in %s", efsUtilsStateDir)
+	}
+
+	tlsMount := &mount.Info{Source: stunnelHost + ":/", Mountpoint: "/persistentvolumes", Fstype: "nfs4", Opts: "rw,port=20049"}
+	entries := []*mount.Info{
+		{Source: "/dev/sda1", Mountpoint: "/", Fstype: "ext4"},
+		tlsMount,
+	}
+
+	if e := FindStunnelMount("fs-1", entries, true); e != tlsMount {
+		t.Errorf("expected the only TLS mount to be used for the only file system, got %v", e)
+	}
+
+	if e := FindStunnelMount("fs-1", entries, false); e != nil {
+		t.Errorf("expected the only TLS mount not to be assumed to belong to one of several file systems, got %v", e)
+	}
+}
@@ -4,19 +4,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"strconv"
+	"strings"
 	"syscall"
 
 	"k8s.io/klog/v2"
-	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/allocator"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
-	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidreclaimer"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
 )
 
-// compile time check to make sure FileSystemReclaimer implements the GIDReclaimer interface
-var _ gidreclaimer.GIDReclaimer = &FileSystemReclaimer{}
-
 func NewFileSystemReclaimer(basePath string) *FileSystemReclaimer {
 	return &FileSystemReclaimer{BasePath: basePath}
 }
@@ -25,8 +20,13 @@ type FileSystemReclaimer struct {
 	BasePath string
 }
 
-// Reclaim looks at every top level directory in the basepath and adds its gid to the given gidTable
-func (f *FileSystemReclaimer) Reclaim(classname string, gidtable *allocator.MinMaxAllocator) error {
+// Reclaim looks at every top level directory in the basepath and adds its gid to the given gidTable.  If byOwner is
+// set, the gids of directories without metadata are reclaimed from their group if it lies in the range gidMin-gidMax.
+// The same goes for directories whose metadata can't be read or fails verification, whatever byOwner is, since
+// their gid could otherwise be handed out again.  Directories whose gid is also the gid of another directory are
+// reported, since it's ambiguous which volume the gid belongs to.  The gids of the storage class's archived volumes are
+// added as well.
+func (f *FileSystemReclaimer) Reclaim(classname string, gidtable *GIDTable, byOwner bool, gidMin, gidMax int) error {
 	klog.Infof("adding gids for any existing directories under %s to the gid table", f.BasePath)
 
 	entries, err := ioutil.ReadDir(f.BasePath)
@@ -35,26 +35,56 @@ func (f *FileSystemReclaimer) Reclaim(classname string, gidtable *allocator.MinM
 		return err
 	}
 
+	// seen holds the directory each gid was first found on
+	seen := map[int]string{}
+	checkAmbiguous := func(gid int, dir string) {
+		if other, ok := seen[gid]; ok {
+			klog.Warningf("gid %d of %s is ambiguous since %s has the same gid", gid, dir, other)
+			return
+		}
+		seen[gid] = dir
+	}
+
+	reclaimedByOwner := 0
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		// the archive, snapshot and metadata directories aren't volumes
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
 			continue
 		}
 
 		mddir := path.Join(f.BasePath, entry.Name())
 
+		// metadata that can't be read or trusted doesn't tell which storage class the directory belongs to, so its
+		// group is reclaimed if this storage class could have allocated it
 		md, err := ReadVolumeMetadata(mddir)
 		if err != nil {
-			klog.Warningf("failed to read volume metadata for %s: %v", mddir, err)
+			gid := int(entry.Sys().(*syscall.Stat_t).Gid)
+			if gid < gidMin || gid > gidMax {
+				klog.Warningf("failed to read volume metadata for %s, its group %d is outside of the range %d-%d: %v", mddir, gid, gidMin, gidMax, err)
+				continue
+			}
+
+			klog.Warningf("failed to read volume metadata for %s, reclaiming the gid %d of its group: %v", mddir, gid, err)
+			checkAmbiguous(gid, mddir)
+			gidtable.Allocate(gid)
 			continue
 		}
 
-		// if no metadata then it must have been created by another storage class that doesn't have reuseVolumes set since those don't write metadata
+		// if no metadata then it must have been created by an older provisioner for a storage class that doesn't have
+		// reuseVolumes set, since those didn't write metadata, so only its group tells which gid it was allocated
 		if md == nil {
-			continue
-		}
+			if !byOwner {
+				continue
+			}
 
-		// skip volumes for other storage classes
-		if md.StorageClassName != classname {
+			gid := int(entry.Sys().(*syscall.Stat_t).Gid)
+			if gid < gidMin || gid > gidMax {
+				continue
+			}
+
+			checkAmbiguous(gid, mddir)
+			gidtable.Allocate(gid)
+			reclaimedByOwner++
 			continue
 		}
 
@@ -63,20 +93,61 @@ func (f *FileSystemReclaimer) Reclaim(classname string, gidtable *allocator.MinM
 			continue
 		}
 
-		gid, err := strconv.Atoi(md.GID)
+		gid, err := ParseGID(md.GID)
 		if err != nil {
 			klog.Errorf("invalid GID value '%s' in metadata for %s", md.GID, mddir)
 			continue
 		}
 
-		_, err = gidtable.Allocate(gid)
-		if err == allocator.ErrConflict {
+		// the gids of volumes of other storage classes are only needed to detect ambiguous gids
+		checkAmbiguous(gid, mddir)
+
+		// skip volumes for other storage classes
+		if md.StorageClassName != classname {
+			continue
+		}
+
+		if !gidtable.Allocate(gid) {
 			klog.Infof("gid %d found in %s was already allocated for storageclass %s", gid, mddir, classname)
 			continue
-		} else if err != nil {
-			klog.Errorf("failed to store GID %d found in metadata for %s: %v", gid, mddir, err)
+		}
+	}
+
+	// the gids of archived volumes stay allocated until the archive sweeper purges them, so that they can be restored
+	archivePath := path.Join(f.BasePath, ArchiveDir)
+	archived, err := ioutil.ReadDir(archivePath)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Errorf("failed to list contents of %s: %v", archivePath, err)
+		return err
+	}
+
+	for _, entry := range archived {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		mddir := path.Join(archivePath, entry.Name())
+
+		md, err := ReadVolumeMetadata(mddir)
+		if err != nil {
+			klog.Warningf("failed to read volume metadata for archived volume %s: %v", mddir, err)
+			continue
+		}
+		if md == nil || md.GID == "" || md.StorageClassName != classname {
+			continue
+		}
+
+		gid, err := ParseGID(md.GID)
+		if err != nil {
+			klog.Errorf("invalid GID value '%s' in metadata for %s", md.GID, mddir)
 			continue
 		}
+
+		gidtable.Allocate(gid)
+	}
+
+	if reclaimedByOwner > 0 {
+		klog.Infof("reclaimed the gids of %d directories under %s without volume metadata from their group for storageclass %s", reclaimedByOwner, f.BasePath, classname)
 	}
 
 	return nil
@@ -103,7 +174,7 @@ func VolumeExists(path string) (bool, uint32, error) {
 // then we assume the PVC now being deployed previously must have resulted in this directory being created because the PVC was deleted,
 // but the directory wasn't (maybe because the reclaim policy on the storage class was set to Retain, or maybe because the entire Kubernetes
 // cluster was destroyed and recreated but the same EFS was reused for the cluster).
-func ValidatePreexistingVolume(options controller.ProvisionOptions, md *VolumeMetadata, volumePath string, existingGID uint32) error {
+func ValidatePreexistingVolume(options controller.ProvisionOptions, md *VolumeMetadata, volumePath string, existingGID uint32, mode os.FileMode) error {
 	if md == nil {
 		return LogErrorf("%s already exists but has no volume metadata", volumePath)
 	}
@@ -130,5 +201,65 @@ func ValidatePreexistingVolume(options controller.ProvisionOptions, md *VolumeMe
 		}
 	}
 
+	if md.UID != "" {
+		mduid, err := md.UidAsUInt()
+		if err != nil {
+			return LogErrorf("metadata for %s contains an invalid uid value '%s'", volumePath, md.UID)
+		}
+
+		stat, err := os.Stat(volumePath)
+		if err != nil {
+			return LogErrorf("failed to stat %s: %v", volumePath, err)
+		}
+
+		if existingUID := stat.Sys().(*syscall.Stat_t).Uid; existingUID != mduid {
+			return LogErrorf("%s already exists, but its uid is %d while the volume metadata says the uid should be %d", volumePath, existingUID, mduid)
+		}
+	}
+
+	if md.Mode != "" {
+		if md.Mode != FormatMode(mode) {
+			return LogErrorf("%s already exists but was created with mode %s instead of the currently requested mode of %s", volumePath, md.Mode, FormatMode(mode))
+		}
+
+		stat, err := os.Stat(volumePath)
+		if err != nil {
+			return LogErrorf("failed to stat %s: %v", volumePath, err)
+		}
+
+		if existingMode := FormatMode(stat.Mode()); existingMode != md.Mode {
+			return LogErrorf("%s already exists, but its mode is %s while the volume metadata says the mode should be %s", volumePath, existingMode, md.Mode)
+		}
+	}
+
+	return nil
+}
+
+// ValidateRestoredVolume determines if the directory can be restored for the given storage class based on the contents
+// of its metadata file.  The GID in the metadata must still be the GID of the directory, and must lie in the range the
+// gid allocator currently hands out GIDs from for the storage class so that it is tracked once the volume is in use.
+func ValidateRestoredVolume(parameters map[string]string, md *VolumeMetadata, volumePath string, existingGID uint32) error {
+	if md.GID == "" {
+		return nil
+	}
+
+	mdgid, err := md.GidAsUInt()
+	if err != nil {
+		return LogErrorf("metadata for %s contains an invalid gid value '%s'", volumePath, md.GID)
+	}
+
+	if existingGID != mdgid {
+		return LogErrorf("%s exists, but its gid is %d while the volume metadata says the gid should be %d", volumePath, existingGID, mdgid)
+	}
+
+	gidMin, gidMax, err := GIDRange(parameters)
+	if err != nil {
+		return LogErrorf("%v", err)
+	}
+
+	if int(mdgid) < gidMin || int(mdgid) > gidMax {
+		return LogErrorf("the gid %d of %s is outside of the range %d-%d of the storage class", mdgid, volumePath, gidMin, gidMax)
+	}
+
 	return nil
 }
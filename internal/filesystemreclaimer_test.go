@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// newTestVolume creates a volume directory owned by the given group
+func newTestVolume(t *testing.T, base, name string, gid int) string {
+	dir := path.Join(base, name)
+	if err := os.Mkdir(dir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(dir, -1, gid); err != nil {
+		t.Skipf("changing the group of %s isn't permitted: %v", dir, err)
+	}
+	return dir
+}
+
+func TestReclaim(t *testing.T) {
+	setTestSigningKey(t, false)
+	base := t.TempDir()
+
+	if err := WriteVolumeMetadata(newTestVolume(t, base, "signed", 2000), VolumeMetadata{GID: "2000", StorageClassName: "efs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteVolumeMetadata(newTestVolume(t, base, "other-class", 2001), VolumeMetadata{GID: "2001", StorageClassName: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	newTestVolume(t, base, "no-metadata", 2002)
+
+	// metadata that fails verification falls back to the group of the directory if it lies in the range
+	for name, gid := range map[string]int{"tampered": 2003, "tampered-out-of-range": 3000} {
+		dir := newTestVolume(t, base, name, gid)
+		if err := ioutil.WriteFile(getMetaDataPath(dir), []byte(`{"gid": "2500", "storageClassName": "efs", "signature": "forged"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		byOwner bool
+		gids    []int
+	}{
+		{byOwner: false, gids: []int{2000, 2003}},
+		{byOwner: true, gids: []int{2000, 2002, 2003}},
+	} {
+		table := NewGIDTable()
+		if err := NewFileSystemReclaimer(base).Reclaim("efs", table, test.byOwner, 2000, 2100); err != nil {
+			t.Fatalf("Reclaim failed: %v", err)
+		}
+		if gids := table.GIDs(); !reflect.DeepEqual(gids, test.gids) {
+			t.Errorf("expected gids %v to be reclaimed with byOwner %t, got %v", test.gids, test.byOwner, gids)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+// ErrGIDAllocated is returned by Reserve if the storage class already allocated the GID
+var ErrGIDAllocated = errors.New("gid is already allocated")
+
+// GIDAllocator allocates a unique GID out of the gidMin-gidMax range of a storage class to every volume of the class
+// on a file system.  Without a store, the GIDs in use by a storage class are collected from the gid annotations of its
+// PVs and from the volume metadata of the directories on the file system the first time a GID of the class is
+// allocated or released, and only kept in memory.  With a store, the GIDs are only collected once to initialize the
+// stored table, and every allocation and release is recorded in the store.  With a registry, the GIDs allocated by
+// other clusters sharing the file system are skipped as well.
+type GIDAllocator struct {
+	client    kubernetes.Interface
+	reclaimer *FileSystemReclaimer
+	store     *GIDStore
+	registry  *GIDRegistry
+
+	tables map[string]*GIDTable
+	lock   sync.Mutex
+}
+
+// NewGIDAllocator creates a GIDAllocator, store and registry may be nil
+func NewGIDAllocator(client kubernetes.Interface, reclaimer *FileSystemReclaimer, store *GIDStore, registry *GIDRegistry) *GIDAllocator {
+	return &GIDAllocator{
+		client:    client,
+		reclaimer: reclaimer,
+		store:     store,
+		registry:  registry,
+		tables:    map[string]*GIDTable{},
+	}
+}
+
+// AllocateNext allocates a free GID in the range of the storage class of the claim being provisioned, picked by the
+// allocation strategy of the storage class.  GIDs in use by the given other storage classes are skipped, so that
+// storage classes whose ranges overlap share the GIDs.
+func (a *GIDAllocator) AllocateNext(ctx context.Context, options controller.ProvisionOptions, sharedClassNames []string) (int, error) {
+	className := util.GetPersistentVolumeClaimClass(options.PVC)
+
+	gidMin, gidMax, err := GIDRange(options.StorageClass.Parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	strategy, err := GIDAllocationStrategy(options.StorageClass.Parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	var gid int
+	err = a.update(ctx, className, func(table *GIDTable) error {
+		shared, err := a.loadShared(ctx, sharedClassNames)
+		if err != nil {
+			return err
+		}
+
+		return a.register(className, table, func(registered []*GIDTable) error {
+			var err error
+			first := firstGID(strategy, options.PVC, gidMin, gidMax)
+			gid, err = table.AllocateFrom(first, gidMin, gidMax, append(shared, registered...)...)
+			if err != nil {
+				return fmt.Errorf("failed to allocate a gid for storage class %s in the range %d-%d: %v", className, gidMin, gidMax, err)
+			}
+			return nil
+		})
+	})
+
+	return gid, err
+}
+
+// Release releases the GID of the given volume, if it was allocated one
+func (a *GIDAllocator) Release(ctx context.Context, volume *v1.PersistentVolume) error {
+	gid, ok, err := volumeGID(volume)
+	if err != nil || !ok {
+		return err
+	}
+
+	return a.ReleaseGID(ctx, util.GetPersistentVolumeClass(volume), gid)
+}
+
+// ReleaseGID releases a GID of the storage class that no volume has anymore, e.g. that of a purged archived volume
+func (a *GIDAllocator) ReleaseGID(ctx context.Context, className string, gid int) error {
+	return a.update(ctx, className, func(table *GIDTable) error {
+		return a.register(className, table, func([]*GIDTable) error {
+			table.Release(gid)
+			return nil
+		})
+	})
+}
+
+// Reserve records that the given GID is in use by a volume of the storage class that wasn't provisioned, e.g. a
+// restored one.  It fails with ErrGIDAllocated if the GID is already allocated by the storage class, and fails if it
+// is allocated by one of the given other storage classes sharing the file system or by another cluster in the
+// registry.  Without a store or registry, the GID is
+// collected from the PV of the volume the next time the provisioner starts.
+func (a *GIDAllocator) Reserve(ctx context.Context, className string, gid int, sharedClassNames []string) error {
+	return a.update(ctx, className, func(table *GIDTable) error {
+		if table.Has(gid) {
+			return fmt.Errorf("gid %d is already allocated by storage class %s: %w", gid, className, ErrGIDAllocated)
+		}
+
+		shared, err := a.loadShared(ctx, sharedClassNames)
+		if err != nil {
+			return err
+		}
+		if hasGID(shared, gid) {
+			return fmt.Errorf("gid %d is already allocated by another storage class sharing the file system", gid)
+		}
+
+		return a.register(className, table, func(registered []*GIDTable) error {
+			if hasGID(registered, gid) {
+				return fmt.Errorf("gid %d is already registered by another storage class or cluster sharing the file system", gid)
+			}
+
+			table.Allocate(gid)
+			return nil
+		})
+	})
+}
+
+// Register records the GIDs in use by a storage class in the registry, so that other clusters sharing the file system
+// don't allocate them, and warns about GIDs that other clusters have registered as well
+func (a *GIDAllocator) Register(ctx context.Context, className string) error {
+	if a.registry == nil {
+		return nil
+	}
+
+	return a.update(ctx, className, func(table *GIDTable) error {
+		return a.register(className, table, func(registered []*GIDTable) error {
+			for _, other := range registered {
+				if overlap := table.Intersection(other); overlap.Len() > 0 {
+					klog.Warningf("gids %s of storage class %s are also registered by another storage class or cluster sharing the file system", overlap, className)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Collect collects the GIDs in use by a storage class from the gid annotations of its PVs and the volume metadata of
+// the directories on the file system, and from the group of directories without metadata if the storage class sets
+// gidReclaimByOwner
+func (a *GIDAllocator) Collect(ctx context.Context, className string) (*GIDTable, error) {
+	table := NewGIDTable()
+
+	pvs, err := a.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if util.GetPersistentVolumeClass(pv) != className {
+			continue
+		}
+
+		gid, ok, err := volumeGID(pv)
+		if err != nil {
+			klog.Errorf("%v", err)
+			continue
+		} else if ok {
+			table.Allocate(gid)
+		}
+	}
+
+	// reclaiming by owner needs the range of the storage class, which is gone along with the storage class
+	var byOwner bool
+	var gidMin, gidMax int
+	class, err := a.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err == nil {
+		if byOwner, err = GIDReclaimByOwner(class.Parameters); err != nil {
+			return nil, err
+		}
+		if gidMin, gidMax, err = GIDRange(class.Parameters); err != nil {
+			return nil, err
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get storage class %s: %v", className, err)
+	}
+
+	if err := a.reclaimer.Reclaim(className, table, byOwner, gidMin, gidMax); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// Store is the store the GID tables are persisted in, or nil if they aren't
+func (a *GIDAllocator) Store() *GIDStore {
+	return a.store
+}
+
+// update applies fn to the GID table of a storage class
+func (a *GIDAllocator) update(ctx context.Context, className string, fn func(*GIDTable) error) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.store != nil {
+		err := a.store.Update(ctx, className, a.collector(ctx, className), fn)
+		if err != nil && a.registry != nil {
+			a.resetRegistry(ctx, className)
+		}
+		return err
+	}
+
+	table, err := a.load(ctx, className)
+	if err != nil {
+		return err
+	}
+
+	// fn is applied to a copy of the table, which only replaces the table once fn, and registering the result, succeed
+	updated := table.Copy()
+	if err := fn(updated); err != nil {
+		return err
+	}
+	a.tables[className] = updated
+
+	return nil
+}
+
+// load returns the GID table of a storage class, which is collected and stored if it isn't stored yet.  The lock must
+// be held.
+func (a *GIDAllocator) load(ctx context.Context, className string) (*GIDTable, error) {
+	if a.store != nil {
+		table, err := a.store.Load(ctx, className)
+		if err != nil || table != nil {
+			return table, err
+		}
+
+		err = a.store.Update(ctx, className, a.collector(ctx, className), func(stored *GIDTable) error {
+			table = stored
+			return nil
+		})
+		return table, err
+	}
+
+	if table, ok := a.tables[className]; ok {
+		return table, nil
+	}
+
+	table, err := a.Collect(ctx, className)
+	if err != nil {
+		return nil, err
+	}
+	a.tables[className] = table
+
+	return table, nil
+}
+
+// loadShared returns the GID tables of the given storage classes.  The lock must be held.
+func (a *GIDAllocator) loadShared(ctx context.Context, classNames []string) ([]*GIDTable, error) {
+	shared := make([]*GIDTable, 0, len(classNames))
+	for _, className := range classNames {
+		table, err := a.load(ctx, className)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, table)
+	}
+
+	return shared, nil
+}
+
+// register applies fn to the GID table of a storage class while the registry is locked, and records the result in
+// the registry.  Without a registry, fn is applied right away.
+func (a *GIDAllocator) register(className string, table *GIDTable, fn func(registered []*GIDTable) error) error {
+	if a.registry == nil {
+		return fn(nil)
+	}
+
+	return a.registry.Update(className, table, fn)
+}
+
+// resetRegistry registers the stored GID table of a storage class again after storing an update of the table failed.
+// The update was registered before the table was stored, so a GID allocated by it would otherwise never be allocated
+// again by any cluster.  The lock must be held.
+func (a *GIDAllocator) resetRegistry(ctx context.Context, className string) {
+	table, err := a.store.Load(ctx, className)
+	if err == nil && table == nil {
+		table, err = a.Collect(ctx, className)
+	}
+	if err != nil {
+		klog.Errorf("failed to reset the registered gids of storage class %s: %v", className, err)
+		return
+	}
+
+	if err := a.registry.Update(className, table, func([]*GIDTable) error { return nil }); err != nil {
+		klog.Errorf("failed to reset the registered gids of storage class %s: %v", className, err)
+	}
+}
+
+func (a *GIDAllocator) collector(ctx context.Context, className string) func() (*GIDTable, error) {
+	return func() (*GIDTable, error) {
+		return a.Collect(ctx, className)
+	}
+}
+
+// firstGID is the GID the search for a free GID starts at with the given allocation strategy
+func firstGID(strategy string, claim *v1.PersistentVolumeClaim, gidMin, gidMax int) int {
+	switch strategy {
+	case GIDAllocationRandom:
+		return gidMin + rand.Intn(gidMax-gidMin+1)
+	case GIDAllocationHash:
+		h := fnv.New64a()
+		h.Write([]byte(claim.Namespace + "/" + claim.Name))
+		return gidMin + int(h.Sum64()%uint64(gidMax-gidMin+1))
+	default:
+		return gidMin
+	}
+}
+
+// volumeGID returns the GID in the gid annotation of a volume, ok is false if it has none
+func volumeGID(volume *v1.PersistentVolume) (gid int, ok bool, err error) {
+	gidStr, ok := volume.Annotations[gidallocator.VolumeGidAnnotationKey]
+	if !ok {
+		return 0, false, nil
+	}
+
+	gid, err = ParseGID(gidStr)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid gid '%s' in the annotations of volume %s: %v", gidStr, volume.Name, err)
+	}
+
+	return gid, true, nil
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/gidallocator"
+)
+
+func newTestPV(name, className, gid string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{gidallocator.VolumeGidAnnotationKey: gid},
+		},
+		Spec: v1.PersistentVolumeSpec{StorageClassName: className},
+	}
+}
+
+func TestReserve(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestPV("pv-1", "efs", "2000"), newTestPV("pv-2", "efs-shared", "2001"))
+	a := NewGIDAllocator(client, NewFileSystemReclaimer(t.TempDir()), nil, nil)
+	ctx := context.Background()
+
+	if err := a.Reserve(ctx, "efs", 2000, []string{"efs-shared"}); err == nil {
+		t.Errorf("expected reserving a gid allocated by the storage class to fail")
+	}
+	if err := a.Reserve(ctx, "efs", 2001, []string{"efs-shared"}); err == nil {
+		t.Errorf("expected reserving a gid allocated by a shared storage class to fail")
+	}
+
+	if err := a.Reserve(ctx, "efs", 2002, []string{"efs-shared"}); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := a.Reserve(ctx, "efs", 2002, []string{"efs-shared"}); err == nil {
+		t.Errorf("expected reserving a gid twice to fail")
+	}
+
+	// the gid of a storage class that doesn't share the file system can be reserved
+	if err := a.Reserve(ctx, "efs", 2001, nil); err != nil {
+		t.Errorf("Reserve failed: %v", err)
+	}
+}
+
+func TestAllocateNextStoreFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	mountpoint := t.TempDir()
+	a := NewGIDAllocator(client, NewFileSystemReclaimer(mountpoint), NewGIDStore(client, "default", "fs-1"), NewGIDRegistry(mountpoint, "cluster-1"))
+	ctx := context.Background()
+
+	className := "efs"
+	options := controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{Name: className},
+			Parameters: map[string]string{"gidMin": "2000", "gidMax": "2100"},
+		},
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+			Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &className},
+		},
+	}
+
+	if gid, err := a.AllocateNext(ctx, options, nil); err != nil || gid != 2000 {
+		t.Fatalf("expected gid 2000, got %d, %v", gid, err)
+	}
+
+	client.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+	if _, err := a.AllocateNext(ctx, options, nil); err == nil {
+		t.Fatalf("expected the allocation to fail when the gid table can't be stored")
+	}
+
+	// another cluster sees the gid that was stored, but not the one whose allocation failed
+	err := NewGIDRegistry(mountpoint, "cluster-2").Update(className, NewGIDTable(), func(registered []*GIDTable) error {
+		if !hasGID(registered, 2000) {
+			t.Errorf("expected gid 2000 to be registered")
+		}
+		if hasGID(registered, 2001) {
+			t.Errorf("expected gid 2001 not to be registered")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
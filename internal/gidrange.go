@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultGidMin = 2000
+	defaultGidMax = math.MaxInt32
+)
+
+// the strategies the gidAllocationStrategy parameter selects to pick the GID of a volume in the range
+const (
+	// GIDAllocationLowest picks the lowest free GID
+	GIDAllocationLowest = "lowest"
+	// GIDAllocationRandom picks a random free GID, so that a GID that was just released isn't handed out right away
+	GIDAllocationRandom = "random"
+	// GIDAllocationHash picks a GID from a hash of the namespace and name of the claim, or the next free GID after it,
+	// so that a claim gets the same GID again in a new cluster
+	GIDAllocationHash = "hash"
+)
+
+// ParseGID parses a GID, which like any GID in a GID table lies in the range 0-4294967295
+func ParseGID(s string) (int, error) {
+	gid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(gid), nil
+}
+
+// GIDRange parses the gidMin and gidMax storage class parameters the same way the gid allocator does
+func GIDRange(parameters map[string]string) (int, int, error) {
+	gidMin, gidMax := defaultGidMin, defaultGidMax
+
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "gidmin":
+			gid, err := ParseGID(v)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			if gid < 1 {
+				return 0, 0, fmt.Errorf("gidMin must be >= 1")
+			}
+			gidMin = gid
+		case "gidmax":
+			gid, err := ParseGID(v)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			if gid < 1 {
+				return 0, 0, fmt.Errorf("gidMax must be >= 1")
+			}
+			gidMax = gid
+		}
+	}
+
+	if gidMin > gidMax {
+		return 0, 0, fmt.Errorf("gidMax %d must be >= gidMin %d", gidMax, gidMin)
+	}
+
+	return gidMin, gidMax, nil
+}
+
+// GIDAllocationStrategy parses the gidAllocationStrategy storage class parameter
+func GIDAllocationStrategy(parameters map[string]string) (string, error) {
+	strategy, ok := parameters["gidAllocationStrategy"]
+	if !ok || strategy == "" {
+		return GIDAllocationLowest, nil
+	}
+
+	switch strategy {
+	case GIDAllocationLowest, GIDAllocationRandom, GIDAllocationHash:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid value '%s' for parameter gidAllocationStrategy: must be %s, %s or %s", strategy, GIDAllocationLowest, GIDAllocationRandom, GIDAllocationHash)
+	}
+}
+
+// GIDReclaimByOwner parses the gidReclaimByOwner storage class parameter, which reclaims the gids of directories
+// without volume metadata from their group
+func GIDReclaimByOwner(parameters map[string]string) (bool, error) {
+	v, ok := parameters["gidReclaimByOwner"]
+	if !ok {
+		return false, nil
+	}
+
+	byOwner, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %s for parameter gidReclaimByOwner: %v", v, err)
+	}
+
+	return byOwner, nil
+}
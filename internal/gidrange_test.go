@@ -0,0 +1,23 @@
+package internal
+
+import "testing"
+
+func TestGIDRangeBounds(t *testing.T) {
+	gidMin, gidMax, err := GIDRange(map[string]string{"gidMin": "3000000000", "gidMax": "4294967295"})
+	if err != nil || gidMin != 3000000000 || gidMax != 4294967295 {
+		t.Errorf("expected the range 3000000000-4294967295, got %d-%d, %v", gidMin, gidMax, err)
+	}
+
+	for _, parameters := range []map[string]string{{"gidMax": "4294967296"}, {"gidMin": "-1"}} {
+		if _, _, err := GIDRange(parameters); err == nil {
+			t.Errorf("expected %v to be refused", parameters)
+		}
+	}
+
+	if gid, ok, err := volumeGID(newTestPV("pv-1", "efs", "4294967295")); err != nil || !ok || gid != 4294967295 {
+		t.Errorf("expected gid 4294967295, got %d, %v, %v", gid, ok, err)
+	}
+	if _, _, err := volumeGID(newTestPV("pv-1", "efs", "4294967296")); err == nil {
+		t.Errorf("expected gid 4294967296 to be refused")
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	gidRegistryFile     = "gid-registry.json"
+	gidRegistryLockFile = "gid-registry.lock"
+
+	// gidRegistryLockTimeout is how long to wait for another cluster to unlock the registry
+	gidRegistryLockTimeout = 30 * time.Second
+	gidRegistryLockRetry   = 100 * time.Millisecond
+)
+
+// GIDRegistry is a file in the metadata directory of a file system that records the GIDs allocated by every cluster
+// that provisions volumes from it, so that clusters sharing a file system never allocate the same GID.  The registry
+// is protected by an advisory lock on a lock file next to it, which the NFS server releases if the client holding it
+// goes away.
+type GIDRegistry struct {
+	dir       string
+	clusterID string
+}
+
+// gidRegistryContents is the contents of the registry file, the GID tables of every cluster by storage class
+type gidRegistryContents struct {
+	Clusters map[string]map[string]string `json:"clusters"`
+}
+
+func NewGIDRegistry(basePath, clusterID string) *GIDRegistry {
+	return &GIDRegistry{dir: path.Join(basePath, MetadataDir), clusterID: clusterID}
+}
+
+// Update locks the registry and calls fn with the GID tables the registry holds for every other cluster and storage
+// class.  Afterwards the given GID table of the storage class in this cluster, which fn may have modified, replaces the
+// one in the registry.  The registry is left unchanged if fn fails.
+func (r *GIDRegistry) Update(className string, table *GIDTable, fn func(registered []*GIDTable) error) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	var registered []*GIDTable
+	for clusterID, classes := range contents.Clusters {
+		for name, gids := range classes {
+			if clusterID == r.clusterID && name == className {
+				continue
+			}
+
+			t, err := ParseGIDTable(gids)
+			if err != nil {
+				return fmt.Errorf("invalid gids of storage class %s of cluster %s in %s: %v", name, clusterID, r.path(), err)
+			}
+			registered = append(registered, t)
+		}
+	}
+
+	if err := fn(registered); err != nil {
+		return err
+	}
+
+	if contents.Clusters[r.clusterID] == nil {
+		contents.Clusters[r.clusterID] = map[string]string{}
+	}
+	contents.Clusters[r.clusterID][className] = table.String()
+
+	return r.write(contents)
+}
+
+func (r *GIDRegistry) path() string {
+	return path.Join(r.dir, gidRegistryFile)
+}
+
+// lock takes the lock on the registry, waiting up to gidRegistryLockTimeout for other clusters to release it
+func (r *GIDRegistry) lock() (func(), error) {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory %s: %v", r.dir, err)
+	}
+
+	lockPath := path.Join(r.dir, gidRegistryLockFile)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", lockPath, err)
+	}
+
+	deadline := time.Now().Add(gidRegistryLockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+		}
+		time.Sleep(gidRegistryLockRetry)
+	}
+
+	return func() {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			klog.Errorf("failed to unlock %s: %v", lockPath, err)
+		}
+		f.Close()
+	}, nil
+}
+
+func (r *GIDRegistry) read() (*gidRegistryContents, error) {
+	contents := &gidRegistryContents{}
+
+	data, err := ioutil.ReadFile(r.path())
+	if os.IsNotExist(err) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", r.path(), err)
+	}
+
+	if err := json.Unmarshal(data, contents); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %v", r.path(), err)
+	}
+	if contents.Clusters == nil {
+		contents.Clusters = map[string]map[string]string{}
+	}
+
+	return contents, nil
+}
+
+// write replaces the registry file the same way metadata files are replaced, so it's never left partially written
+func (r *GIDRegistry) write(contents *gidRegistryContents) error {
+	data, err := json.Marshal(contents)
+	if err != nil {
+		return fmt.Errorf("failed to marshal gid registry: %v", err)
+	}
+
+	tmppath, err := writeTempFileSync(r.dir, gidRegistryFile+".*"+metadataTempSuffix, data)
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file for %s: %v", r.path(), err)
+	}
+
+	if err := os.Rename(tmppath, r.path()); err != nil {
+		os.Remove(tmppath)
+		return fmt.Errorf("failed to rename %s to %s: %v", tmppath, r.path(), err)
+	}
+
+	return syncDir(r.dir)
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	gidStoreNamePrefix = "efs-provisioner-gids-"
+
+	gidStoreGIDsKey             = "gids"
+	gidStoreFileSystemIDKey     = "fileSystemId"
+	gidStoreStorageClassNameKey = "storageClassName"
+
+	// maxConfigMapNameLength is the maximum length of the name of a ConfigMap, which is a DNS subdomain
+	maxConfigMapNameLength = 253
+)
+
+// GIDStore persists the GID table of every storage class in a ConfigMap per file system and storage class, so that
+// the tables don't need to be collected from every PV and directory when the provisioner starts
+type GIDStore struct {
+	client       kubernetes.Interface
+	namespace    string
+	fileSystemID string
+}
+
+func NewGIDStore(client kubernetes.Interface, namespace, fileSystemID string) *GIDStore {
+	return &GIDStore{client: client, namespace: namespace, fileSystemID: fileSystemID}
+}
+
+// Load returns the stored GID table of a storage class, or nil if none is stored yet
+func (s *GIDStore) Load(ctx context.Context, className string) (*GIDTable, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.configMapName(className), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get gid table of storage class %s: %v", className, err)
+	}
+
+	return s.parse(cm)
+}
+
+// Update applies fn to the stored GID table of a storage class and stores the result.  If no table is stored yet, the
+// table returned by collect is stored instead.  The ConfigMap is only updated if nobody else updated it since it was
+// read, otherwise fn is applied again to the table that was stored in the meantime, so every update is applied once
+// to the latest table.
+func (s *GIDStore) Update(ctx context.Context, className string, collect func() (*GIDTable, error), fn func(*GIDTable) error) error {
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	name := s.configMapName(className)
+
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.namespace},
+				Data: map[string]string{
+					gidStoreFileSystemIDKey:     s.fileSystemID,
+					gidStoreStorageClassNameKey: className,
+				},
+			}
+		} else if err != nil {
+			return fmt.Errorf("failed to get gid table of storage class %s: %v", className, err)
+		}
+
+		var table *GIDTable
+		if exists {
+			table, err = s.parse(cm)
+		} else {
+			klog.Infof("storing the gid table of storage class %s in ConfigMap %s/%s", className, s.namespace, name)
+			table, err = collect()
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(table); err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[gidStoreGIDsKey] = table.String()
+
+		if exists {
+			_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		} else {
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		}
+		if err != nil && !retriable(err) {
+			return fmt.Errorf("failed to store gid table of storage class %s: %v", className, err)
+		}
+		return err
+	})
+}
+
+func (s *GIDStore) parse(cm *v1.ConfigMap) (*GIDTable, error) {
+	table, err := ParseGIDTable(cm.Data[gidStoreGIDsKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid table in ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+	}
+	return table, nil
+}
+
+// configMapName is the name of the ConfigMap holding the GID table of a storage class, which is made unique with a
+// hash if the file system id and class name are too long for the name of a ConfigMap
+func (s *GIDStore) configMapName(className string) string {
+	name := gidStoreNamePrefix + s.fileSystemID + "-" + className
+	if len(name) <= maxConfigMapNameLength {
+		return name
+	}
+
+	hash := sha256.Sum256([]byte(s.fileSystemID + "/" + className))
+	return strings.TrimRight(name[:maxConfigMapNameLength-17], ".-") + "-" + hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrGIDRangeFull is returned when every GID in the range of a storage class is allocated
+var ErrGIDRangeFull = errors.New("all gids in the range are allocated")
+
+// GIDTable is the set of GIDs allocated to the volumes of a storage class.  GIDs outside of the current range of the
+// storage class are kept too, since the range may have been changed after they were allocated.  The GIDs are kept as
+// ranges of consecutive GIDs, so a table is as small as its formatted form however many GIDs it holds.
+type GIDTable struct {
+	// ranges are sorted, and neither overlap nor touch each other
+	ranges []gidRange
+}
+
+// gidRange is the range of GIDs first-last
+type gidRange struct {
+	first, last int
+}
+
+func NewGIDTable() *GIDTable {
+	return &GIDTable{}
+}
+
+// Allocate marks the given GID as allocated and returns false if it already was
+func (t *GIDTable) Allocate(gid int) bool {
+	if t.Has(gid) {
+		return false
+	}
+	t.add(gid, gid)
+	return true
+}
+
+// AllocateNext allocates the lowest GID in the range gidMin-gidMax that is neither allocated in this table nor in any
+// of the shared tables
+func (t *GIDTable) AllocateNext(gidMin, gidMax int, shared ...*GIDTable) (int, error) {
+	return t.AllocateFrom(gidMin, gidMin, gidMax, shared...)
+}
+
+// AllocateFrom allocates the first GID from first on that is neither allocated in this table nor in any of the shared
+// tables, wrapping around to gidMin at the end of the range gidMin-gidMax.  Only the ranges of allocated GIDs are
+// walked, so allocating from a nearly full range of a billion GIDs is as fast as from an empty one.
+func (t *GIDTable) AllocateFrom(first, gidMin, gidMax int, shared ...*GIDTable) (int, error) {
+	if first < gidMin || first > gidMax {
+		first = gidMin
+	}
+
+	tables := append([]*GIDTable{t}, shared...)
+	gid, ok := firstFreeGID(tables, first, gidMax)
+	if !ok {
+		gid, ok = firstFreeGID(tables, gidMin, first-1)
+	}
+	if !ok {
+		return 0, ErrGIDRangeFull
+	}
+
+	t.Allocate(gid)
+	return gid, nil
+}
+
+// firstFreeGID returns the lowest GID in the range from-to that isn't allocated in any of the tables
+func firstFreeGID(tables []*GIDTable, from, to int) (int, bool) {
+	for gid := from; gid <= to; {
+		free := true
+		for _, t := range tables {
+			if r, ok := t.rangeOf(gid); ok {
+				gid = r.last + 1
+				free = false
+			}
+		}
+		if free {
+			return gid, true
+		}
+	}
+	return 0, false
+}
+
+func hasGID(tables []*GIDTable, gid int) bool {
+	for _, t := range tables {
+		if t.Has(gid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *GIDTable) Release(gid int) {
+	t.ranges = subtractRanges(t.ranges, []gidRange{{gid, gid}})
+}
+
+func (t *GIDTable) Has(gid int) bool {
+	_, ok := t.rangeOf(gid)
+	return ok
+}
+
+// rangeOf returns the range of allocated GIDs that holds the given GID
+func (t *GIDTable) rangeOf(gid int) (gidRange, bool) {
+	i := sort.Search(len(t.ranges), func(i int) bool { return t.ranges[i].last >= gid })
+	if i < len(t.ranges) && t.ranges[i].first <= gid {
+		return t.ranges[i], true
+	}
+	return gidRange{}, false
+}
+
+// add allocates the GIDs first-last, merging them with the ranges they overlap or touch
+func (t *GIDTable) add(first, last int) {
+	i := sort.Search(len(t.ranges), func(i int) bool { return t.ranges[i].last >= first-1 })
+	j := i
+	for ; j < len(t.ranges) && t.ranges[j].first <= last+1; j++ {
+		if t.ranges[j].first < first {
+			first = t.ranges[j].first
+		}
+		if t.ranges[j].last > last {
+			last = t.ranges[j].last
+		}
+	}
+
+	ranges := append([]gidRange{}, t.ranges[:i]...)
+	ranges = append(ranges, gidRange{first, last})
+	t.ranges = append(ranges, t.ranges[j:]...)
+}
+
+// Copy returns a table with the same GIDs allocated as this one
+func (t *GIDTable) Copy() *GIDTable {
+	return &GIDTable{ranges: append([]gidRange(nil), t.ranges...)}
+}
+
+// Add allocates every GID that is allocated in the other table
+func (t *GIDTable) Add(other *GIDTable) {
+	for _, r := range other.ranges {
+		t.add(r.first, r.last)
+	}
+}
+
+// Remove releases every GID that is allocated in the other table
+func (t *GIDTable) Remove(other *GIDTable) {
+	t.ranges = subtractRanges(t.ranges, other.ranges)
+}
+
+// Difference returns a table of the GIDs that are allocated in this table but not in the other
+func (t *GIDTable) Difference(other *GIDTable) *GIDTable {
+	return &GIDTable{ranges: subtractRanges(t.ranges, other.ranges)}
+}
+
+// Intersection returns a table of the GIDs that are allocated in both this table and the other
+func (t *GIDTable) Intersection(other *GIDTable) *GIDTable {
+	return t.Difference(t.Difference(other))
+}
+
+// subtractRanges returns the GIDs in the sorted ranges a that aren't in the sorted ranges b
+func subtractRanges(a, b []gidRange) []gidRange {
+	var result []gidRange
+	j := 0
+	for _, r := range a {
+		first := r.first
+		for j < len(b) && b[j].last < first {
+			j++
+		}
+		for k := j; k < len(b) && b[k].first <= r.last && first <= r.last; k++ {
+			if b[k].first > first {
+				result = append(result, gidRange{first, b[k].first - 1})
+			}
+			if b[k].last+1 > first {
+				first = b[k].last + 1
+			}
+		}
+		if first <= r.last {
+			result = append(result, gidRange{first, r.last})
+		}
+	}
+	return result
+}
+
+// Len returns the number of allocated GIDs
+func (t *GIDTable) Len() int {
+	n := 0
+	for _, r := range t.ranges {
+		n += r.last - r.first + 1
+	}
+	return n
+}
+
+// GIDs returns the allocated GIDs in ascending order
+func (t *GIDTable) GIDs() []int {
+	gids := make([]int, 0, t.Len())
+	for _, r := range t.ranges {
+		for gid := r.first; gid <= r.last; gid++ {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+// String formats the allocated GIDs as a comma separated list of GIDs and ranges of consecutive GIDs, e.g.
+// "2000-2003,2010", which keeps the table of a storage class with tens of thousands of volumes small
+func (t *GIDTable) String() string {
+	var b strings.Builder
+
+	for _, r := range t.ranges {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(r.first))
+		if r.last > r.first {
+			b.WriteByte('-')
+			b.WriteString(strconv.Itoa(r.last))
+		}
+	}
+
+	return b.String()
+}
+
+// ParseGIDTable parses a table formatted by GIDTable.String.  Tables are stored where they can be edited, so GIDs
+// outside of 0-4294967295 and ranges that end before they start are refused.
+func ParseGIDTable(s string) (*GIDTable, error) {
+	t := NewGIDTable()
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.ParseUint(first, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid '%s': %v", part, err)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.ParseUint(last, 10, 32); err != nil || to < from {
+				return nil, fmt.Errorf("invalid gid range '%s'", part)
+			}
+		}
+
+		t.add(int(from), int(to))
+	}
+
+	return t, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGIDTableString(t *testing.T) {
+	table := NewGIDTable()
+	for _, gid := range []int{2010, 2000, 2001, 2002, 2003, 2012, 2013} {
+		table.Allocate(gid)
+	}
+
+	if s := table.String(); s != "2000-2003,2010,2012-2013" {
+		t.Errorf("expected 2000-2003,2010,2012-2013, got %s", s)
+	}
+	if s := NewGIDTable().String(); s != "" {
+		t.Errorf("expected an empty table to be formatted as an empty string, got %s", s)
+	}
+}
+
+func TestParseGIDTable(t *testing.T) {
+	table, err := ParseGIDTable(" 2000-2003, 2010,,2012-2013 ")
+	if err != nil {
+		t.Fatalf("ParseGIDTable failed: %v", err)
+	}
+	if gids, expected := table.GIDs(), []int{2000, 2001, 2002, 2003, 2010, 2012, 2013}; !reflect.DeepEqual(gids, expected) {
+		t.Errorf("expected %v, got %v", expected, gids)
+	}
+
+	if table, err := ParseGIDTable(""); err != nil || len(table.GIDs()) != 0 {
+		t.Errorf("expected an empty table, got %v, %v", table, err)
+	}
+
+	for _, s := range []string{"abc", "2000-", "2003-2000", "2000-abc", "4294967296", "-1", "0-4294967296"} {
+		if _, err := ParseGIDTable(s); err == nil {
+			t.Errorf("expected '%s' to be refused", s)
+		}
+	}
+}
+
+func TestParseGIDTableWholeRange(t *testing.T) {
+	// the whole range is kept as a single range rather than billions of gids
+	table, err := ParseGIDTable("0-4294967295")
+	if err != nil {
+		t.Fatalf("ParseGIDTable failed: %v", err)
+	}
+	if n := table.Len(); n != math.MaxUint32+1 {
+		t.Errorf("expected %d gids, got %d", math.MaxUint32+1, n)
+	}
+
+	table.Release(2000)
+	if s := table.String(); s != "0-1999,2001-4294967295" {
+		t.Errorf("expected 0-1999,2001-4294967295, got %s", s)
+	}
+	if gid, err := table.AllocateNext(defaultGidMin, defaultGidMax); err != nil || gid != 2000 {
+		t.Errorf("expected gid 2000, got %d, %v", gid, err)
+	}
+}
+
+func TestGIDTableDifference(t *testing.T) {
+	a, _ := ParseGIDTable("2000-2010,2020,2030-2040")
+	b, _ := ParseGIDTable("1990-2002,2005,2009-2025,2035")
+
+	if s := a.Difference(b).String(); s != "2003-2004,2006-2008,2030-2034,2036-2040" {
+		t.Errorf("expected 2003-2004,2006-2008,2030-2034,2036-2040, got %s", s)
+	}
+	if s := a.Intersection(b).String(); s != "2000-2002,2005,2009-2010,2020,2035" {
+		t.Errorf("expected 2000-2002,2005,2009-2010,2020,2035, got %s", s)
+	}
+
+	a.Add(b)
+	if s := a.String(); s != "1990-2025,2030-2040" {
+		t.Errorf("expected 1990-2025,2030-2040, got %s", s)
+	}
+	a.Remove(b)
+	if s := a.String(); s != "2003-2004,2006-2008,2030-2034,2036-2040" {
+		t.Errorf("expected 2003-2004,2006-2008,2030-2034,2036-2040, got %s", s)
+	}
+}
+
+func TestGIDTableCopy(t *testing.T) {
+	table, _ := ParseGIDTable("2000-2010")
+	copied := table.Copy()
+
+	copied.Allocate(2011)
+	copied.Release(2005)
+	if s := table.String(); s != "2000-2010" {
+		t.Errorf("expected changes to the copy to leave the table unchanged, got %s", s)
+	}
+	if s := copied.String(); s != "2000-2004,2006-2011" {
+		t.Errorf("expected 2000-2004,2006-2011, got %s", s)
+	}
+}
+
+func TestGIDTableRoundTrip(t *testing.T) {
+	table := NewGIDTable()
+	for gid := 5000; gid < 5100; gid += 3 {
+		table.Allocate(gid)
+		table.Allocate(gid + 1)
+	}
+
+	parsed, err := ParseGIDTable(table.String())
+	if err != nil {
+		t.Fatalf("ParseGIDTable failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.GIDs(), table.GIDs()) {
+		t.Errorf("expected %v, got %v", table.GIDs(), parsed.GIDs())
+	}
+}
+
+func TestGIDTableAllocateFrom(t *testing.T) {
+	table := NewGIDTable()
+	shared := NewGIDTable()
+	for _, gid := range []int{2000, 2001, 2005} {
+		table.Allocate(gid)
+	}
+	shared.Allocate(2006)
+
+	for _, expected := range []int{2007, 2008, 2009, 2002, 2003, 2004} {
+		if gid, err := table.AllocateFrom(2005, 2000, 2009, shared); err != nil || gid != expected {
+			t.Errorf("expected gid %d, got %d, %v", expected, gid, err)
+		}
+	}
+	if gid, err := table.AllocateFrom(2005, 2000, 2009, shared); err != ErrGIDRangeFull {
+		t.Errorf("expected the range to be full, got %d, %v", gid, err)
+	}
+
+	// the end of the default range is full, which must not take a pass over every gid in the range
+	table = NewGIDTable()
+	for gid := math.MaxInt32 - 999; gid <= math.MaxInt32; gid++ {
+		table.Allocate(gid)
+	}
+	if gid, err := table.AllocateFrom(math.MaxInt32-500, defaultGidMin, defaultGidMax); err != nil || gid != defaultGidMin {
+		t.Errorf("expected the allocation to wrap around to gid %d, got %d, %v", defaultGidMin, gid, err)
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// UnixMode converts the permission and special bits of an os.FileMode to the bits chmod(2) uses
+func UnixMode(mode os.FileMode) uint32 {
+	unixMode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		unixMode |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		unixMode |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		unixMode |= syscall.S_ISVTX
+	}
+
+	return unixMode
+}
+
+// FileMode converts the bits chmod(2) uses to an os.FileMode
+func FileMode(unixMode uint32) os.FileMode {
+	mode := os.FileMode(unixMode) & os.ModePerm
+	if unixMode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if unixMode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if unixMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// FormatMode formats the permission and special bits of an os.FileMode in octal, the way chmod(1) takes them
+func FormatMode(mode os.FileMode) string {
+	return "0" + strconv.FormatUint(uint64(UnixMode(mode)), 8)
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/mount"
+)
+
+const (
+	// healthCheckTimeout is how long a stat of the mountpoint may take before the mount is considered hung
+	healthCheckTimeout = 30 * time.Second
+
+	// unmountTimeout is how long umount may take before it is killed
+	unmountTimeout = 30 * time.Second
+)
+
+// DefaultNFSMountOptions are the mount options recommended by AWS for mounting EFS with the NFS client
+var DefaultNFSMountOptions = []string{"nfsvers=4.1", "rsize=1048576", "wsize=1048576", "hard", "timeo=600", "retrans=2", "noresvport"}
+
+func NewMounter(server, remotePath, mountpoint string, options []string) *Mounter {
+	return &Mounter{
+		Server:     server,
+		RemotePath: remotePath,
+		Mountpoint: mountpoint,
+		Options:    options,
+	}
+}
+
+// Mounter mounts a path of an EFS file system with the NFS client and keeps it mounted
+type Mounter struct {
+	Server     string
+	RemotePath string
+	Mountpoint string
+	Options    []string
+
+	// stat receives the result of a stat of the mountpoint that hasn't returned yet.  A stat of a hung hard mount never
+	// returns, so later checks wait for the same stat instead of leaving another goroutine stuck behind every time.
+	stat chan error
+}
+
+// Source is the source of the mount as it appears in /proc/mounts
+func (m *Mounter) Source() string {
+	return m.Server + ":" + m.RemotePath
+}
+
+// Mount mounts the file system unless it is already mounted
+func (m *Mounter) Mount() error {
+	mounted, err := m.IsMounted()
+	if err != nil {
+		return err
+	}
+	if mounted {
+		klog.Infof("%s is already mounted at %s", m.Source(), m.Mountpoint)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Mountpoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mountpoint %s: %v", m.Mountpoint, err)
+	}
+
+	klog.Infof("mounting %s at %s", m.Source(), m.Mountpoint)
+
+	cmd := exec.Command("mount", "-t", "nfs4", "-o", strings.Join(m.Options, ","), m.Source(), m.Mountpoint)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mount of %s at %s failed with error: %v, output: %s", m.Source(), m.Mountpoint, err, out)
+	}
+
+	return nil
+}
+
+// Unmount unmounts the file system, falling back to a lazy unmount if it is busy or hung
+func (m *Mounter) Unmount() error {
+	klog.Infof("unmounting %s", m.Mountpoint)
+
+	out, err := m.umount()
+	if err != nil {
+		klog.Warningf("umount of %s failed with error: %v, output: %s, trying a lazy unmount", m.Mountpoint, err, out)
+
+		// a lazy unmount detaches the mountpoint right away without waiting for the server
+		if out, err = m.umount("-l"); err != nil {
+			return fmt.Errorf("lazy umount of %s failed with error: %v, output: %s", m.Mountpoint, err, out)
+		}
+	}
+
+	return nil
+}
+
+// umount runs umount with the given flags on the mountpoint, killing it if it takes longer than unmountTimeout
+func (m *Mounter) umount(flags ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), unmountTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "umount", append(flags, m.Mountpoint)...)
+	// don't wait for the output of a killed umount forever either
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return out, fmt.Errorf("umount did not finish within %v", unmountTimeout)
+	}
+
+	return out, err
+}
+
+// IsMounted determines if the file system is mounted at the mountpoint
+func (m *Mounter) IsMounted() (bool, error) {
+	entries, err := mount.GetMounts()
+	if err != nil {
+		return false, err
+	}
+
+	for _, e := range entries {
+		if e.Mountpoint == m.Mountpoint && e.Source == m.Source() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Check verifies that the file system is mounted and responsive.  It must not be called concurrently.
+func (m *Mounter) Check() error {
+	mounted, err := m.IsMounted()
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("%s is not mounted at %s", m.Source(), m.Mountpoint)
+	}
+
+	// a stat of a hung hard mount never returns, so don't wait on it forever
+	if m.stat == nil {
+		stat := make(chan error, 1)
+		go func() {
+			_, err := os.Stat(m.Mountpoint)
+			stat <- err
+		}()
+		m.stat = stat
+	}
+
+	select {
+	case err := <-m.stat:
+		m.stat = nil
+		if err != nil {
+			return fmt.Errorf("%s is not accessible: %v", m.Mountpoint, err)
+		}
+		return nil
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("%s did not respond within %v", m.Mountpoint, healthCheckTimeout)
+	}
+}
+
+// Watch checks the mount every interval and remounts the file system whenever the check fails, until the context is done
+func (m *Mounter) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := m.Check()
+		if err == nil {
+			continue
+		}
+
+		klog.Warningf("remounting %s: %v", m.Mountpoint, err)
+
+		if mounted, _ := m.IsMounted(); mounted {
+			if err := m.Unmount(); err != nil {
+				klog.Errorf("%v", err)
+				continue
+			}
+		}
+
+		// a stat stuck on the old mount never returns, so the checks of the new mount start over
+		m.stat = nil
+
+		if err := m.Mount(); err != nil {
+			klog.Errorf("%v", err)
+		}
+	}
+}
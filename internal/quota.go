@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"os"
+	"strconv"
+)
+
+// MakeReadOnly removes the write bits from the mode of the given directory so that nothing can be created in it, and
+// returns its original mode in octal so it can be restored with RestoreMode
+func MakeReadOnly(dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", LogErrorf("failed to stat %s: %v", dir, err)
+	}
+
+	if err := os.Chmod(dir, FileMode(UnixMode(info.Mode())&^0222)); err != nil {
+		return "", LogErrorf("failed to chmod %s: %v", dir, err)
+	}
+
+	return strconv.FormatUint(uint64(UnixMode(info.Mode())), 8), nil
+}
+
+// RestoreMode sets the mode of the given directory to a mode returned by MakeReadOnly
+func RestoreMode(dir, mode string) error {
+	unixMode, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return LogErrorf("invalid mode '%s' for %s: %v", mode, dir, err)
+	}
+
+	if err := os.Chmod(dir, FileMode(uint32(unixMode))); err != nil {
+		return LogErrorf("failed to chmod %s: %v", dir, err)
+	}
+
+	return nil
+}
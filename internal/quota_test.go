@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMakeReadOnlySetgidDirectory(t *testing.T) {
+	dir := path.Join(t.TempDir(), "volume")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mode := os.ModeSetgid | os.ModeSticky | 0775
+	if err := os.Chmod(dir, mode); err != nil {
+		t.Fatal(err)
+	}
+
+	originalMode, err := MakeReadOnly(dir)
+	if err != nil {
+		t.Fatalf("MakeReadOnly failed: %v", err)
+	}
+	if originalMode != "3775" {
+		t.Errorf("expected original mode 3775, got %s", originalMode)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky) != os.ModeSetgid|os.ModeSticky|0555 {
+		t.Errorf("expected the directory to keep its setgid and sticky bits and lose its write bits, got mode %v", info.Mode())
+	}
+
+	if err := RestoreMode(dir, originalMode); err != nil {
+		t.Fatalf("RestoreMode failed: %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky) != mode {
+		t.Errorf("expected mode %v to be restored, got %v", mode, info.Mode())
+	}
+}
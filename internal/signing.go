@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+)
+
+// ErrInvalidMetadataSignature is returned when volume metadata isn't signed with the metadata signing key
+var ErrInvalidMetadataSignature = errors.New("volume metadata signature is missing or invalid")
+
+var metadataSigning struct {
+	key           []byte
+	allowUnsigned bool
+}
+
+// SetMetadataSigningKey makes WriteVolumeMetadata sign volume metadata with an HMAC using the given key, and
+// ReadVolumeMetadata reject metadata that isn't signed with it.  If allowUnsigned is set, metadata without a signature,
+// such as that written before signing was enabled, is still accepted.
+func SetMetadataSigningKey(key []byte, allowUnsigned bool) {
+	metadataSigning.key = key
+	metadataSigning.allowUnsigned = allowUnsigned
+}
+
+// signMetadata returns the serialized metadata of the given directory with its signature if a signing key is set
+func signMetadata(dir string, md VolumeMetadata) ([]byte, error) {
+	md.Signature = ""
+
+	contents, err := json.MarshalIndent(md, "", "  ")
+	if err != nil || metadataSigning.key == nil {
+		return contents, err
+	}
+
+	if md.Signature, err = metadataSignature(dir, contents); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(md, "", "  ")
+}
+
+// verifyMetadata checks the signature of the serialized metadata of the given directory if a signing key is set
+func verifyMetadata(dir string, contents []byte, md *VolumeMetadata) error {
+	if metadataSigning.key == nil {
+		return nil
+	}
+
+	if md.Signature == "" && metadataSigning.allowUnsigned {
+		return nil
+	}
+
+	signature, err := metadataSignature(dir, contents)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(md.Signature)) {
+		return ErrInvalidMetadataSignature
+	}
+
+	return nil
+}
+
+// metadataSignature computes the signature of the serialized metadata of the given directory.  The name of the
+// directory is signed along with the metadata, so that the metadata of one directory can't be copied to another.  The
+// fields are signed in a canonical form, sorted and without whitespace, so that the signature doesn't depend on the
+// fields VolumeMetadata has in this version.
+func metadataSignature(dir string, contents []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "signature")
+
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, metadataSigning.key)
+	mac.Write([]byte(path.Base(dir)))
+	mac.Write([]byte{0})
+	mac.Write(canonical)
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
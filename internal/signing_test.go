@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// setTestSigningKey enables metadata signing for the duration of a test
+func setTestSigningKey(t *testing.T, allowUnsigned bool) {
+	SetMetadataSigningKey([]byte("test-key"), allowUnsigned)
+	t.Cleanup(func() { SetMetadataSigningKey(nil, false) })
+}
+
+func TestMetadataSignature(t *testing.T) {
+	setTestSigningKey(t, false)
+	base := t.TempDir()
+	dir := path.Join(base, "data-pvc-1")
+
+	if err := WriteVolumeMetadata(dir, VolumeMetadata{GID: "2000", PVCName: "data"}); err != nil {
+		t.Fatalf("WriteVolumeMetadata failed: %v", err)
+	}
+
+	md, err := ReadVolumeMetadata(dir)
+	if err != nil {
+		t.Fatalf("ReadVolumeMetadata failed: %v", err)
+	}
+	if md.GID != "2000" || md.Signature == "" {
+		t.Errorf("expected signed metadata with gid 2000, got %+v", md)
+	}
+
+	contents, err := ioutil.ReadFile(getMetaDataPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata copied to another directory isn't valid for it
+	other := path.Join(base, "other-pvc-2")
+	if err := ioutil.WriteFile(getMetaDataPath(other), contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadVolumeMetadata(other); !errors.Is(err, ErrInvalidMetadataSignature) {
+		t.Errorf("expected metadata copied from another directory to be refused, got %v", err)
+	}
+
+	// neither is metadata whose fields were changed
+	tampered := strings.Replace(string(contents), `"2000"`, `"2001"`, 1)
+	if err := ioutil.WriteFile(getMetaDataPath(dir), []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadVolumeMetadata(dir); !errors.Is(err, ErrInvalidMetadataSignature) {
+		t.Errorf("expected modified metadata to be refused, got %v", err)
+	}
+}
+
+func TestVerifyMetadataUnsigned(t *testing.T) {
+	contents := []byte(`{"gid": "2000"}`)
+
+	for _, allowUnsigned := range []bool{false, true} {
+		setTestSigningKey(t, allowUnsigned)
+
+		md := &VolumeMetadata{}
+		if err := json.Unmarshal(contents, md); err != nil {
+			t.Fatal(err)
+		}
+
+		err := verifyMetadata("/persistentvolumes/data-pvc-1", contents, md)
+		if allowUnsigned && err != nil {
+			t.Errorf("expected unsigned metadata to be accepted if unsigned metadata is, got %v", err)
+		} else if !allowUnsigned && !errors.Is(err, ErrInvalidMetadataSignature) {
+			t.Errorf("expected unsigned metadata to be refused unless unsigned metadata is accepted, got %v", err)
+		}
+	}
+}
+
+func TestMoveVolumeMetadataSignsAgain(t *testing.T) {
+	setTestSigningKey(t, false)
+	base := t.TempDir()
+	from, to := path.Join(base, "data-pvc-1"), path.Join(base, ArchiveDir, "data-pvc-1-20240101T000000Z")
+
+	if err := WriteVolumeMetadata(from, VolumeMetadata{GID: "2000"}); err != nil {
+		t.Fatalf("WriteVolumeMetadata failed: %v", err)
+	}
+
+	if err := MoveVolumeMetadata(from, to); err != nil {
+		t.Fatalf("MoveVolumeMetadata failed: %v", err)
+	}
+
+	md, err := ReadVolumeMetadata(to)
+	if err != nil || md == nil || md.GID != "2000" {
+		t.Errorf("expected the moved metadata to be valid for %s, got %+v, %v", to, md, err)
+	}
+	if _, err := os.Stat(getMetaDataPath(from)); !os.IsNotExist(err) {
+		t.Errorf("expected the metadata of %s to be gone, got %v", from, err)
+	}
+}
+
+func TestMigrateVolumeMetadataUnsigned(t *testing.T) {
+	setTestSigningKey(t, false)
+	base := t.TempDir()
+	dir := path.Join(base, "data-pvc-1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a pod using the volume could have written the legacy metadata file
+	if err := ioutil.WriteFile(path.Join(dir, legacyMetadataFile), []byte(`{"gid": "2000", "signature": "forged"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateVolumeMetadata(base); err != nil {
+		t.Fatalf("MigrateVolumeMetadata failed: %v", err)
+	}
+
+	if _, err := ReadVolumeMetadata(dir); !errors.Is(err, ErrInvalidMetadataSignature) {
+		t.Errorf("expected the migrated metadata not to be signed, got %v", err)
+	}
+
+	setTestSigningKey(t, true)
+	if md, err := ReadVolumeMetadata(dir); err != nil || md == nil || md.GID != "2000" || md.Signature != "" {
+		t.Errorf("expected unsigned metadata with gid 2000, got %+v, %v", md, err)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// SnapshotDir is the directory under the base path that holds the snapshots of volumes
+	SnapshotDir = ".snapshots"
+
+	// snapshotPerm keeps the provisioner from accidentally modifying a snapshot once it has been taken
+	snapshotPerm = 0555
+)
+
+// CreateSnapshot copies the given volume directory to snapshotPath and records which volume it is a snapshot of in
+// its volume metadata.  Anything left at snapshotPath by an interrupted snapshot is replaced.
+func CreateSnapshot(volumePath, snapshotPath, snapshotName string) error {
+	// the snapshot area is only accessible to the provisioner
+	if err := os.MkdirAll(path.Dir(snapshotPath), 0700); err != nil {
+		return LogErrorf("failed to create snapshot directory %s: %v", path.Dir(snapshotPath), err)
+	}
+
+	if err := DeleteSnapshot(snapshotPath); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(snapshotPath, 0700); err != nil {
+		return LogErrorf("failed to create %s: %v", snapshotPath, err)
+	}
+
+	klog.Infof("copying %s to snapshot %s", volumePath, snapshotPath)
+
+	if err := CopyTree(volumePath, snapshotPath, nil, nil); err != nil {
+		DeleteSnapshot(snapshotPath)
+		return LogErrorf("failed to copy %s to %s: %v", volumePath, snapshotPath, err)
+	}
+
+	md, err := ReadVolumeMetadata(volumePath)
+	if err != nil {
+		klog.Warningf("failed to read volume metadata for %s: %v", volumePath, err)
+	}
+	if md == nil {
+		md = &VolumeMetadata{}
+	}
+
+	now := time.Now().UTC()
+	md.SnapshotName = snapshotName
+	md.SnapshotAt = &now
+
+	if err := WriteVolumeMetadata(snapshotPath, *md); err != nil {
+		DeleteSnapshot(snapshotPath)
+		return err
+	}
+
+	if err := os.Chmod(snapshotPath, snapshotPerm); err != nil {
+		DeleteSnapshot(snapshotPath)
+		return LogErrorf("failed to chmod %s: %v", snapshotPath, err)
+	}
+
+	klog.Infof("finished snapshot %s of %s", snapshotPath, volumePath)
+
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot at the given path if it exists
+func DeleteSnapshot(snapshotPath string) error {
+	if err := os.Chmod(snapshotPath, 0700); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return LogErrorf("failed to chmod %s: %v", snapshotPath, err)
+	}
+
+	if err := os.RemoveAll(snapshotPath); err != nil {
+		return LogErrorf("failed to delete snapshot %s: %v", snapshotPath, err)
+	}
+
+	return DeleteVolumeMetadata(snapshotPath)
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultUidMin leaves out root, since a directory owned by root isn't of much use to the pods of a claim that
+	// can choose its owner
+	defaultUidMin = 1
+	defaultUidMax = math.MaxInt32
+)
+
+// UIDRange parses the uidMin and uidMax storage class parameters, which limit the UIDs claims may ask their volume to
+// be owned by.  ok is false if neither is set, in which case claims can't choose a UID.  The range may only include
+// root if the allowRootUid parameter is set.
+func UIDRange(parameters map[string]string) (uidMin int, uidMax int, ok bool, err error) {
+	allowRoot, err := AllowRootUID(parameters)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	uidMin, uidMax = defaultUidMin, defaultUidMax
+
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "uidmin":
+			uid, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return 0, 0, false, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			if uid < 0 {
+				return 0, 0, false, fmt.Errorf("uidMin must be >= 0")
+			}
+			uidMin = int(uid)
+			ok = true
+		case "uidmax":
+			uid, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return 0, 0, false, fmt.Errorf("invalid value %s for parameter %s: %v", v, k, err)
+			}
+			if uid < 0 {
+				return 0, 0, false, fmt.Errorf("uidMax must be >= 0")
+			}
+			uidMax = int(uid)
+			ok = true
+		}
+	}
+
+	if uidMin == 0 && !allowRoot {
+		return 0, 0, false, fmt.Errorf("uidMin 0 lets claims own their directory as root, set allowRootUid to allow it")
+	}
+
+	if uidMin > uidMax {
+		return 0, 0, false, fmt.Errorf("uidMax %d must be >= uidMin %d", uidMax, uidMin)
+	}
+
+	return uidMin, uidMax, ok, nil
+}
+
+// AllowRootUID parses the allowRootUid storage class parameter, which lets the directory of a volume be owned by root
+// through the uid parameter or the uidMin-uidMax range
+func AllowRootUID(parameters map[string]string) (bool, error) {
+	v, ok := parameters["allowRootUid"]
+	if !ok {
+		return false, nil
+	}
+
+	allowRoot, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %s for parameter allowRootUid: %v", v, err)
+	}
+
+	return allowRoot, nil
+}
@@ -0,0 +1,38 @@
+package internal
+
+import "testing"
+
+func TestUIDRange(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		uidMin     int
+		uidMax     int
+		ok         bool
+		err        bool
+	}{
+		{parameters: map[string]string{}, uidMin: 1, uidMax: defaultUidMax},
+		{parameters: map[string]string{"uidMax": "2000"}, uidMin: 1, uidMax: 2000, ok: true},
+		{parameters: map[string]string{"uidMin": "1000", "uidMax": "2000"}, uidMin: 1000, uidMax: 2000, ok: true},
+		{parameters: map[string]string{"uidMin": "0"}, err: true},
+		{parameters: map[string]string{"uidMin": "0", "allowRootUid": "true"}, uidMin: 0, uidMax: defaultUidMax, ok: true},
+		{parameters: map[string]string{"uidMin": "0", "allowRootUid": "yes"}, err: true},
+		{parameters: map[string]string{"uidMin": "2000", "uidMax": "1000"}, err: true},
+		{parameters: map[string]string{"uidMin": "-1"}, err: true},
+	}
+
+	for _, test := range tests {
+		uidMin, uidMax, ok, err := UIDRange(test.parameters)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected %v to be refused", test.parameters)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("UIDRange(%v) failed: %v", test.parameters, err)
+		} else if uidMin != test.uidMin || uidMax != test.uidMax || ok != test.ok {
+			t.Errorf("expected %d-%d, %t for %v, got %d-%d, %t", test.uidMin, test.uidMax, test.ok, test.parameters, uidMin, uidMax, ok)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/time/rate"
+)
+
+// Usage is the space and number of inodes taken up by a directory
+type Usage struct {
+	Bytes  int64
+	Inodes int64
+}
+
+// DirectoryUsage adds up the size of everything under the given directory, including the directory itself.  Every
+// entry has to be stat'ed, which counts against the throughput of the file system, so the walk waits on the limiter
+// before each entry.  Hard links are counted once per link.
+func DirectoryUsage(ctx context.Context, dir string, limiter *rate.Limiter) (Usage, error) {
+	var usage Usage
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may be deleted while the directory is walked
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		usage.Bytes += info.Size()
+		usage.Inodes++
+		return nil
+	})
+
+	return usage, err
+}
@@ -1,9 +1,16 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"encoding/json"
 	"io/ioutil"
@@ -12,14 +19,90 @@ import (
 )
 
 const (
-	metadataFile = ".kube-efs-provisioner-metadata"
+	// MetadataDir is the directory next to the directories the provisioner manages that holds their metadata.  Pods
+	// only ever mount the directories themselves, so they can't modify the metadata.
+	MetadataDir = ".efs-provisioner"
+
+	metadataSubdir = "meta"
+
+	// legacyMetadataFile is the file inside the directory of a volume older provisioners kept its metadata in
+	legacyMetadataFile = ".kube-efs-provisioner-metadata"
+
+	// metadataTempSuffix is appended to the name of a metadata file and a random number to get the temporary file it's
+	// written to
+	metadataTempSuffix = ".tmp"
+
+	// metadataTempGracePeriod is how old a temporary metadata file must be before it's taken to be left behind by an
+	// interrupted write, rather than still being written by another provisioner sharing the file system
+	metadataTempGracePeriod = 10 * time.Minute
+
+	// metadataMigratedFile marks a directory whose legacy metadata files have been migrated
+	metadataMigratedFile = "metadata-migrated"
 )
 
+// VolumeMetadataSchemaVersion is the version of the volume metadata written by this provisioner.  Metadata without a
+// version was written by older provisioners, which only recorded the GID, PVC name and namespace and storage class.
+const VolumeMetadataSchemaVersion = 2
+
+// metadataLock serializes reading and writing metadata files
+var metadataLock sync.Mutex
+
+// metadataTempChecks records when each metadata directory was last checked for temporary files left behind by
+// interrupted writes.  It's guarded by metadataLock.
+var metadataTempChecks = map[string]time.Time{}
+
 type VolumeMetadata struct {
+	SchemaVersion    int    `json:"schemaVersion,omitempty"`
 	GID              string `json:"gid"`
 	PVCName          string `json:"pvcName"`
 	PVCNamespace     string `json:"pvcNamespace"`
 	StorageClassName string `json:"storageClassName"`
+	// UID is only set on volumes whose directory is owned by a UID chosen by the storage class or claim
+	UID string `json:"uid,omitempty"`
+	// Mode is the mode the directory was created with in octal, it is missing from the metadata of older volumes
+	Mode string `json:"mode,omitempty"`
+
+	// the PV and PVC the directory is currently provisioned for
+	PVName    string            `json:"pvName,omitempty"`
+	PVCUID    string            `json:"pvcUID,omitempty"`
+	PVCLabels map[string]string `json:"pvcLabels,omitempty"`
+
+	// CreatedAt, Provisioner, ProvisionerVersion and ClusterID describe where the directory was created
+	CreatedAt          *time.Time `json:"createdAt,omitempty"`
+	Provisioner        string     `json:"provisioner,omitempty"`
+	ProvisionerVersion string     `json:"provisionerVersion,omitempty"`
+	ClusterID          string     `json:"clusterID,omitempty"`
+
+	// History lists every PV the directory was provisioned for, oldest first
+	History []VolumeBinding `json:"history,omitempty"`
+
+	// ArchivedAt and ArchivedFrom are only set on volumes that were archived instead of deleted
+	ArchivedAt   *time.Time `json:"archivedAt,omitempty"`
+	ArchivedFrom string     `json:"archivedFrom,omitempty"`
+	// SnapshotName and SnapshotAt are only set on snapshots of volumes
+	SnapshotName string     `json:"snapshotName,omitempty"`
+	SnapshotAt   *time.Time `json:"snapshotAt,omitempty"`
+	// ClonedFrom is the local path of the data source a cloned volume is populated from, and ClonedAt is only set once
+	// the copy is complete
+	ClonedFrom string     `json:"clonedFrom,omitempty"`
+	ClonedAt   *time.Time `json:"clonedAt,omitempty"`
+
+	// Signature is an HMAC of the other fields if metadata signing is enabled
+	Signature string `json:"signature,omitempty"`
+}
+
+// VolumeBinding records a PV that a directory was provisioned for
+type VolumeBinding struct {
+	PVName        string    `json:"pvName"`
+	PVCName       string    `json:"pvcName"`
+	PVCNamespace  string    `json:"pvcNamespace"`
+	PVCUID        string    `json:"pvcUID"`
+	ProvisionedAt time.Time `json:"provisionedAt"`
+}
+
+// CloneIncomplete determines if the directory is a clone whose copy of its data source never completed
+func (v VolumeMetadata) CloneIncomplete() bool {
+	return v.ClonedFrom != "" && v.ClonedAt == nil
 }
 
 func (v VolumeMetadata) GidAsUInt() (uint32, error) {
@@ -31,47 +114,439 @@ func (v VolumeMetadata) GidAsUInt() (uint32, error) {
 	return uint32(gid), nil
 }
 
-// WriteVolumeMetadata writes a serialized version of the given VolumeMetadata object to the given directory.
-func WriteVolumeMetadata(dir string, md VolumeMetadata) error {
-	mdpath := getMetaDataPath(dir)
+func (v VolumeMetadata) UidAsUInt() (uint32, error) {
+	uid, err := strconv.ParseUint(v.UID, 10, 32)
+	if err != nil {
+		return 0, err
+	}
 
-	contents, err := json.MarshalIndent(md, "", "  ")
+	return uint32(uid), nil
+}
+
+// WriteVolumeMetadata writes a serialized version of the given VolumeMetadata object for the given directory.  The
+// metadata is written to a temporary file with a unique name that is synced and then renamed over the metadata file,
+// so the metadata file is never left partially written, even if several provisioners write it at once.
+func WriteVolumeMetadata(dir string, md VolumeMetadata) error {
+	contents, err := signMetadata(dir, md)
 	if err != nil {
 		klog.Errorf("failed to marshal metadata: %v", err)
 		return err
 	}
 
-	if err := ioutil.WriteFile(mdpath, contents, 0600); err != nil {
+	return writeVolumeMetadata(dir, contents)
+}
+
+// writeVolumeMetadata replaces the metadata file of the given directory with the serialized metadata like
+// WriteVolumeMetadata does
+func writeVolumeMetadata(dir string, contents []byte) error {
+	mdpath := getMetaDataPath(dir)
+
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	if err := os.MkdirAll(path.Dir(mdpath), 0700); err != nil {
+		klog.Errorf("failed to create metadata directory %v: %v", path.Dir(mdpath), err)
+		return err
+	}
+
+	tmppath, err := writeTempFileSync(path.Dir(mdpath), path.Base(mdpath)+".*"+metadataTempSuffix, contents)
+	if err != nil {
 		klog.Errorf("failed to write metadata file %v: %v", mdpath, err)
 		return err
 	}
 
+	if err := os.Rename(tmppath, mdpath); err != nil {
+		os.Remove(tmppath)
+		klog.Errorf("failed to rename %v to %v: %v", tmppath, mdpath, err)
+		return err
+	}
+
+	if err := syncDir(path.Dir(mdpath)); err != nil {
+		klog.Errorf("failed to sync metadata directory %v: %v", path.Dir(mdpath), err)
+		return err
+	}
+
 	return nil
 }
 
-// ReadVolumeMetadata reads the metadata file in the given directory and returns a *VolumeMetadata with the contents.
+// writeTempFileSync writes a new file in dir whose name is made from pattern like os.CreateTemp does, and waits until
+// its contents are on stable storage.  It returns the path of the file, which is removed if writing it fails.
+func writeTempFileSync(dir, pattern string, contents []byte) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = f.Write(contents); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// syncDir waits until the entries of a directory, e.g. a file renamed into it, are on stable storage
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// ReadVolumeMetadata reads the metadata file of the given directory and returns a *VolumeMetadata with the contents.
+// Interrupted writes of the metadata files in the same metadata directory are repaired first.
 func ReadVolumeMetadata(dir string) (*VolumeMetadata, error) {
-	md := &VolumeMetadata{}
 	mdpath := getMetaDataPath(dir)
 
-	r, err := os.Open(mdpath)
-	if os.IsNotExist(err) {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	repairInterruptedWrites(path.Dir(mdpath))
+
+	md, err := readMetadataFile(dir, mdpath)
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil, nil
 	} else if err != nil {
-		klog.Errorf("failed to read metadata file %v: %v", mdpath, err)
+		klog.Errorf("%v", err)
 		return nil, err
 	}
-	defer r.Close()
 
-	dec := json.NewDecoder(r)
-	if err := dec.Decode(md); err != nil {
-		klog.Errorf("failed to unmarshal %v: %v", mdpath, err)
+	return md, nil
+}
+
+// repairInterruptedWrites completes or discards the writes of metadata files in the given metadata directory that were
+// interrupted before their temporary file was renamed.  Only temporary files older than metadataTempGracePeriod are
+// taken to be left behind, so the directory is checked at most once per grace period.  A complete temporary file that
+// is newer than its metadata file holds the latest metadata and replaces it, any other is removed.  The lock must be
+// held.
+func repairInterruptedWrites(metaDir string) {
+	now := time.Now()
+	if now.Sub(metadataTempChecks[metaDir]) < metadataTempGracePeriod {
+		return
+	}
+	metadataTempChecks[metaDir] = now
+
+	entries, err := os.ReadDir(metaDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("failed to list contents of %v: %v", metaDir, err)
+		}
+		return
+	}
+
+	var left []fs.FileInfo
+	for _, entry := range entries {
+		if _, ok := metadataTempFileName(entry.Name()); !ok {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) >= metadataTempGracePeriod {
+			left = append(left, info)
+		}
+	}
+
+	// the newest temporary file of a metadata file is applied last
+	sort.Slice(left, func(i, j int) bool { return left[i].ModTime().Before(left[j].ModTime()) })
+
+	for _, info := range left {
+		name, _ := metadataTempFileName(info.Name())
+		tmppath, mdpath := path.Join(metaDir, info.Name()), path.Join(metaDir, name)
+		dir := path.Join(path.Dir(path.Dir(metaDir)), strings.TrimSuffix(name, ".json"))
+
+		_, err := readMetadataFile(dir, tmppath)
+		if err == nil {
+			mdinfo, statErr := os.Stat(mdpath)
+			if os.IsNotExist(statErr) || (statErr == nil && info.ModTime().After(mdinfo.ModTime())) {
+				klog.Warningf("completing interrupted write of metadata file %v", mdpath)
+				if err := os.Rename(tmppath, mdpath); err != nil {
+					klog.Errorf("failed to rename %v to %v: %v", tmppath, mdpath, err)
+				}
+				continue
+			}
+			err = fmt.Errorf("metadata file %v is newer", mdpath)
+		}
+
+		klog.Warningf("discarding metadata file %v left behind by an interrupted write: %v", tmppath, err)
+		if err := os.Remove(tmppath); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove %v: %v", tmppath, err)
+		}
+	}
+}
+
+// metadataTempFileName returns the name of the metadata file the temporary file with the given name was written for
+func metadataTempFileName(tmpname string) (string, bool) {
+	name := strings.TrimSuffix(tmpname, metadataTempSuffix)
+	i := strings.LastIndex(name, ".")
+	if name == tmpname || i < 0 || !strings.HasSuffix(name[:i], ".json") {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(name[i+1:], 10, 64); err != nil {
+		return "", false
+	}
+
+	return name[:i], true
+}
+
+// removeMetadataTempFiles removes the temporary files of the metadata file at mdpath, so that a metadata file that was
+// deleted or moved isn't brought back from one of them
+func removeMetadataTempFiles(mdpath string) error {
+	entries, err := os.ReadDir(path.Dir(mdpath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if name, ok := metadataTempFileName(entry.Name()); ok && name == path.Base(mdpath) {
+			if err := os.Remove(path.Join(path.Dir(mdpath), entry.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readMetadataFile reads and verifies a single metadata file of the given directory
+func readMetadataFile(dir, mdpath string) (*VolumeMetadata, error) {
+	md := &VolumeMetadata{}
+
+	contents, err := ioutil.ReadFile(mdpath)
+	if err != nil {
 		return nil, err
 	}
 
+	if err := json.Unmarshal(contents, md); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %v: %v", mdpath, err)
+	}
+
+	if err := verifyMetadata(dir, contents, md); err != nil {
+		return nil, fmt.Errorf("refusing to use metadata file %v: %w", mdpath, err)
+	}
+
+	// the original format has no version, and its fields are still read the same way
+	if md.SchemaVersion == 0 {
+		md.SchemaVersion = 1
+	}
+
+	if md.SchemaVersion > VolumeMetadataSchemaVersion {
+		return nil, fmt.Errorf("metadata file %v has schema version %d, which is newer than the supported version %d", mdpath, md.SchemaVersion, VolumeMetadataSchemaVersion)
+	}
+
 	return md, nil
 }
 
+// DeleteVolumeMetadata deletes the metadata file of the given directory, and any temporary file of an interrupted
+// write of it, if they exist
+func DeleteVolumeMetadata(dir string) error {
+	mdpath := getMetaDataPath(dir)
+
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	if err := removeMetadataTempFiles(mdpath); err != nil {
+		klog.Errorf("failed to delete temporary files of metadata file %v: %v", mdpath, err)
+		return err
+	}
+
+	if err := os.Remove(mdpath); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("failed to delete metadata file %v: %v", mdpath, err)
+		return err
+	}
+
+	return nil
+}
+
+// MoveVolumeMetadata moves the metadata file of a directory that was moved from one path to another along with it.
+// The metadata is signed for the name of its directory, so it's signed again for the new name unless it can't be
+// trusted in the first place, in which case it's moved as it is.
+func MoveVolumeMetadata(from, to string) error {
+	md, err := ReadVolumeMetadata(from)
+	if errors.Is(err, ErrInvalidMetadataSignature) {
+		klog.Warningf("moving volume metadata of %s to %s without signing it again: %v", from, to, err)
+		return renameVolumeMetadata(from, to)
+	} else if err != nil {
+		return err
+	} else if md == nil {
+		return nil
+	}
+
+	if err := WriteVolumeMetadata(to, *md); err != nil {
+		return err
+	}
+
+	return DeleteVolumeMetadata(from)
+}
+
+// renameVolumeMetadata moves the metadata file of a directory to the metadata file of another as it is
+func renameVolumeMetadata(from, to string) error {
+	frompath, topath := getMetaDataPath(from), getMetaDataPath(to)
+
+	if err := os.MkdirAll(path.Dir(topath), 0700); err != nil {
+		klog.Errorf("failed to create metadata directory %v: %v", path.Dir(topath), err)
+		return err
+	}
+
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	if err := os.Rename(frompath, topath); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("failed to move metadata file %v to %v: %v", frompath, topath, err)
+		return err
+	}
+
+	if err := removeMetadataTempFiles(frompath); err != nil {
+		klog.Errorf("failed to delete temporary files of metadata file %v: %v", frompath, err)
+		return err
+	}
+
+	return nil
+}
+
+// getMetaDataPath returns the path of the metadata file of the given directory, which is kept in the metadata directory
+// next to it, e.g. the metadata of /persistentvolumes/pvc-1 is in /persistentvolumes/.efs-provisioner/meta/pvc-1.json
 func getMetaDataPath(dir string) string {
-	return path.Join(dir, metadataFile)
+	return path.Join(path.Dir(dir), MetadataDir, metadataSubdir, path.Base(dir)+".json")
+}
+
+// FindVolumeByPVName returns the path of the directory under basePath whose volume metadata says it is provisioned for
+// the given PV, or an empty string if there is none
+func FindVolumeByPVName(basePath, pvName string) (string, error) {
+	dirs, err := findVolumes(basePath, func(md *VolumeMetadata) bool {
+		return md.PVName == pvName
+	})
+	if err != nil || len(dirs) == 0 {
+		return "", err
+	}
+
+	return dirs[0], nil
+}
+
+// FindVolumesByGID returns the paths of the directories under basePath whose volume metadata says they were allocated
+// the given GID
+func FindVolumesByGID(basePath, gid string) ([]string, error) {
+	return findVolumes(basePath, func(md *VolumeMetadata) bool {
+		return md.GID == gid
+	})
+}
+
+// findVolumes returns the paths of the top level directories under basePath whose volume metadata matches
+func findVolumes(basePath string, match func(*VolumeMetadata) bool) ([]string, error) {
+	entries, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return nil, LogErrorf("failed to list contents of %s: %v", basePath, err)
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		dir := path.Join(basePath, entry.Name())
+		md, err := ReadVolumeMetadata(dir)
+		if err != nil {
+			klog.Warningf("failed to read volume metadata for %s: %v", dir, err)
+			continue
+		}
+
+		if md != nil && match(md) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+// MigrateVolumeMetadata moves the metadata files older provisioners kept inside the directories under basePath, and
+// under the archive and snapshot directories, into the metadata directory.  It only does so once per directory, since
+// a legacy metadata file that shows up later was written by a pod rather than the provisioner and can't be trusted.
+// Since pods could have modified the legacy metadata files before they were migrated as well, they are migrated
+// without a signature, so that their metadata is only trusted as much as metadata written before signing was enabled.
+func MigrateVolumeMetadata(basePath string) error {
+	for _, dir := range []string{basePath, path.Join(basePath, ArchiveDir), path.Join(basePath, SnapshotDir)} {
+		if err := migrateVolumeMetadata(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateVolumeMetadata(dir string) error {
+	markerPath := path.Join(dir, MetadataDir, metadataMigratedFile)
+
+	if _, err := os.Stat(markerPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return LogErrorf("failed to determine if the metadata in %s was migrated: %v", dir, err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return LogErrorf("failed to list contents of %s: %v", dir, err)
+	}
+
+	klog.Infof("migrating volume metadata in %s to %s", dir, path.Join(dir, MetadataDir))
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		volumePath := path.Join(dir, entry.Name())
+		legacyPath := path.Join(volumePath, legacyMetadataFile)
+
+		contents, err := ioutil.ReadFile(legacyPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return LogErrorf("failed to read metadata file %s: %v", legacyPath, err)
+		}
+
+		// a metadata file that was already migrated, e.g. by a provisioner that crashed before writing the marker, wins
+		if _, err := os.Stat(getMetaDataPath(volumePath)); os.IsNotExist(err) {
+			md := &VolumeMetadata{}
+			if err := json.Unmarshal(contents, md); err != nil {
+				klog.Warningf("not migrating invalid metadata file %s: %v", legacyPath, err)
+				continue
+			}
+			md.Signature = ""
+			unsigned, err := json.MarshalIndent(md, "", "  ")
+			if err != nil {
+				return LogErrorf("failed to marshal metadata of %s: %v", legacyPath, err)
+			}
+			if err := writeVolumeMetadata(volumePath, unsigned); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return LogErrorf("failed to stat %s: %v", getMetaDataPath(volumePath), err)
+		}
+
+		if err := os.Remove(legacyPath); err != nil {
+			return LogErrorf("failed to remove metadata file %s: %v", legacyPath, err)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(markerPath), 0700); err != nil {
+		return LogErrorf("failed to create metadata directory %s: %v", path.Dir(markerPath), err)
+	}
+
+	if err := ioutil.WriteFile(markerPath, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0600); err != nil {
+		return LogErrorf("failed to write %s: %v", markerPath, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepairInterruptedWrites(t *testing.T) {
+	base := t.TempDir()
+	dir := path.Join(base, "data-pvc-1")
+	if err := WriteVolumeMetadata(dir, VolumeMetadata{GID: "2000"}); err != nil {
+		t.Fatalf("WriteVolumeMetadata failed: %v", err)
+	}
+
+	mdpath := getMetaDataPath(dir)
+	metaDir := path.Dir(mdpath)
+	writeTemp := func(name string, contents []byte, age time.Duration) string {
+		tmppath := path.Join(metaDir, name)
+		if err := ioutil.WriteFile(tmppath, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(tmppath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return tmppath
+	}
+
+	// an interrupted write after the metadata file was last written, a write that may still be in progress and an
+	// interrupted write of another metadata file that never completed
+	complete, err := signMetadata(dir, VolumeMetadata{GID: "2001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inProgress, err := signMetadata(dir, VolumeMetadata{GID: "2002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-2 * metadataTempGracePeriod)
+	if err := os.Chtimes(mdpath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := writeTemp("data-pvc-1.json.1"+metadataTempSuffix, complete, metadataTempGracePeriod+time.Minute)
+	recent := writeTemp("data-pvc-1.json.2"+metadataTempSuffix, inProgress, 0)
+	partial := writeTemp("other-pvc-2.json.3"+metadataTempSuffix, []byte("{"), metadataTempGracePeriod+time.Minute)
+
+	md, err := ReadVolumeMetadata(dir)
+	if err != nil || md == nil || md.GID != "2001" {
+		t.Errorf("expected the interrupted write to be completed, got %+v, %v", md, err)
+	}
+	for _, tmppath := range []string{interrupted, partial} {
+		if _, err := os.Stat(tmppath); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone, got %v", tmppath, err)
+		}
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("expected %s to be left alone: %v", recent, err)
+	}
+
+	// a deleted metadata file isn't brought back by a write that was in progress
+	if err := DeleteVolumeMetadata(dir); err != nil {
+		t.Fatalf("DeleteVolumeMetadata failed: %v", err)
+	}
+	if _, err := os.Stat(recent); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted along with the metadata file, got %v", recent, err)
+	}
+}
+
+func TestMetadataTempFileName(t *testing.T) {
+	tests := map[string]string{
+		"data-pvc-1.json.123456" + metadataTempSuffix: "data-pvc-1.json",
+		"data.pvc.json.1" + metadataTempSuffix:        "data.pvc.json",
+		"data-pvc-1.json" + metadataTempSuffix:        "",
+		"data-pvc-1.json.abc" + metadataTempSuffix:    "",
+		"data-pvc-1.json":                             "",
+	}
+
+	for tmpname, expected := range tests {
+		if name, ok := metadataTempFileName(tmpname); name != expected || ok != (expected != "") {
+			t.Errorf("expected %s to be a temporary file of '%s', got '%s', %v", tmpname, expected, name, ok)
+		}
+	}
+}